@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The control API is only a thin layer: requests are passed to the main loop, which owns all of the state, and the
+// handler waits for the reply.
+
+type controlAction uint8
+
+const (
+	controlStatus controlAction = iota
+	controlPause
+	controlResume
+	controlMaintenance
+)
+
+type controlCommand struct {
+	action controlAction
+	enable bool // for controlMaintenance
+	reply  chan controlReply
+}
+
+type controlReply struct {
+	status *standbyStatus
+	err    error
+}
+
+type standbyStatus struct {
+	Account     string               `json:"account"`
+	Network     string               `json:"network"`
+	Active      bool                 `json:"active"`
+	Paused      bool                 `json:"paused"`
+	Maintenance bool                 `json:"maintenance"`
+	Unhealthy   bool                 `json:"unhealthy"`
+	Failcount   int                  `json:"failcount"`
+	Failovers   int                  `json:"failovers"`
+	Changed     time.Time            `json:"changed"`
+	Reason      string               `json:"reason"`
+	HeadBlock   uint32               `json:"head_block"`
+	HeadTime    time.Time            `json:"head_time"`
+	Before      string               `json:"neighbor_before"`
+	After       string               `json:"neighbor_after"`
+	LastHealthy map[string]time.Time `json:"last_healthy"`
+	Primary     *primaryStatus       `json:"primary,omitempty"`
+}
+
+// primaryStatus is the last heartbeat from the primary's agent
+type primaryStatus struct {
+	Live      bool      `json:"live"`
+	Paused    bool      `json:"paused"`
+	HeadBlock uint32    `json:"head_block"`
+	Sent      time.Time `json:"sent"`
+}
+
+type controlResponse struct {
+	Ok     bool           `json:"ok"`
+	Error  string         `json:"error,omitempty"`
+	Status *standbyStatus `json:"status,omitempty"`
+}
+
+// controlHandler serves the status and control API. A token is required, and it should only listen on localhost.
+func controlHandler(token string, commands chan<- controlCommand) http.Handler {
+	send := func(w http.ResponseWriter, cmd controlCommand) {
+		cmd.reply = make(chan controlReply, 1)
+		commands <- cmd
+		reply := <-cmd.reply
+		resp := controlResponse{Ok: reply.err == nil, Status: reply.status}
+		w.Header().Set("Content-Type", "application/json")
+		if reply.err != nil {
+			resp.Error = reply.err.Error()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	auth := func(method string, next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if r.Method != method {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", auth(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		send(w, controlCommand{action: controlStatus})
+	}))
+	mux.HandleFunc("/pause", auth(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		send(w, controlCommand{action: controlPause})
+	}))
+	mux.HandleFunc("/resume", auth(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		send(w, controlCommand{action: controlResume})
+	}))
+	mux.HandleFunc("/maintenance", auth(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		enable := true
+		if e := r.URL.Query().Get("enabled"); e != "" {
+			var err error
+			if enable, err = strconv.ParseBool(e); err != nil {
+				http.Error(w, "invalid value for 'enabled'", http.StatusBadRequest)
+				return
+			}
+		}
+		send(w, controlCommand{action: controlMaintenance, enable: enable})
+	}))
+	return mux
+}
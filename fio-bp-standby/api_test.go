@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlHandler(t *testing.T) {
+	commands := make(chan controlCommand)
+	go func() {
+		maintenance := false
+		for cmd := range commands {
+			if cmd.action == controlMaintenance {
+				maintenance = cmd.enable
+			}
+			cmd.reply <- controlReply{status: &standbyStatus{Account: testBp, Maintenance: maintenance}}
+		}
+	}()
+	defer close(commands)
+	server := httptest.NewServer(controlHandler("token", commands))
+	defer server.Close()
+
+	call := func(method, path, token string) (int, *controlResponse) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		cr := &controlResponse{}
+		_ = json.NewDecoder(resp.Body).Decode(cr)
+		return resp.StatusCode, cr
+	}
+
+	if code, _ := call(http.MethodGet, "/status", "wrong"); code != http.StatusUnauthorized {
+		t.Error("expected unauthorized, got", code)
+	}
+	if code, _ := call(http.MethodGet, "/pause", "token"); code != http.StatusMethodNotAllowed {
+		t.Error("pause should require POST, got", code)
+	}
+	code, cr := call(http.MethodGet, "/status", "token")
+	if code != http.StatusOK || !cr.Ok || cr.Status.Account != testBp {
+		t.Errorf("unexpected status response %d %+v", code, cr)
+	}
+	if _, cr = call(http.MethodPost, "/maintenance", "token"); !cr.Status.Maintenance {
+		t.Error("maintenance mode should be enabled")
+	}
+	if _, cr = call(http.MethodPost, "/maintenance?enabled=false", "token"); cr.Status.Maintenance {
+		t.Error("maintenance mode should be disabled")
+	}
+}
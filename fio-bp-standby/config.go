@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thresholds control how quickly the standby declares the primary missing, and when it gives up. These are
+// different between networks, testnet has far fewer producers and is much less reliable.
+type thresholds struct {
+	MissedIncrements  int           `yaml:"missed_increments"`   // times head doesn't increment during our turn before resuming
+	MissedRoundBlocks uint32        `yaml:"missed_round_blocks"` // blocks since our last produced block to declare a missed round
+	ScheduleAge       time.Duration `yaml:"schedule_age"`        // minimum age of the schedule before checking for missed rounds
+	MaxFailures       int           `yaml:"max_failures"`        // consecutive errors before exiting
+	HeartbeatTimeout  time.Duration `yaml:"heartbeat_timeout"`   // how long a routine can be quiet before exiting
+	CrashRestarts     int           `yaml:"crash_restarts"`      // restarts within crash_window to alert on a crash loop
+	CrashWindow       time.Duration `yaml:"crash_window"`        // how far back to count restarts
+	MinPeers          int           `yaml:"min_peers"`           // connected p2p peers needed to resume, 0 to skip
+	MaxHeadLag        uint32        `yaml:"max_head_lag"`        // blocks the head can be behind the fork endpoints to resume, 0 to skip
+	LibStall          time.Duration `yaml:"lib_stall"`           // won't resume if the irreversible block hasn't moved for this long, 0 to skip
+	MinFreeMB         int64         `yaml:"min_free_mb"`         // free space in the state db needed to resume, 0 to skip
+	WitnessStale      time.Duration `yaml:"witness_stale"`       // a witness votes missing if the head is this old during our turn
+	PrimaryTimeout    time.Duration `yaml:"primary_timeout"`     // the primary's heartbeat is lost if none arrives for this long
+	SignedWindow      time.Duration `yaml:"signed_window"`       // won't resume if we signed a block this recently, 0 to skip
+}
+
+func defaultThresholds() thresholds {
+	return thresholds{
+		MissedIncrements:  3,
+		MissedRoundBlocks: 21 * 13,
+		ScheduleAge:       6 * time.Minute,
+		MaxFailures:       10,
+		HeartbeatTimeout:  5 * time.Minute,
+		CrashRestarts:     3,
+		CrashWindow:       10 * time.Minute,
+		MinPeers:          2,
+		MaxHeadLag:        12,
+		LibStall:          2 * time.Minute,
+		MinFreeMB:         256,
+		WitnessStale:      2 * time.Second,
+		PrimaryTimeout:    5 * time.Second,
+		SignedWindow:      3 * time.Second,
+	}
+}
+
+func (t thresholds) validate() error {
+	switch {
+	case t.MissedIncrements < 1:
+		return errors.New("missed_increments must be at least 1")
+	case t.MissedRoundBlocks < 12:
+		return errors.New("missed_round_blocks must be at least 12, one producer's turn")
+	case t.ScheduleAge < 0:
+		return errors.New("schedule_age cannot be negative")
+	case t.MaxFailures < 1:
+		return errors.New("max_failures must be at least 1")
+	case t.HeartbeatTimeout < time.Minute:
+		return errors.New("heartbeat_timeout must be at least 1m")
+	case t.CrashRestarts < 1:
+		return errors.New("crash_restarts must be at least 1")
+	case t.CrashWindow < time.Minute:
+		return errors.New("crash_window must be at least 1m")
+	case t.MinPeers < 0:
+		return errors.New("min_peers cannot be negative")
+	case t.LibStall != 0 && t.LibStall < 10*time.Second:
+		return errors.New("lib_stall must be at least 10s, or 0 to skip the check")
+	case t.MinFreeMB < 0:
+		return errors.New("min_free_mb cannot be negative")
+	case t.WitnessStale < 500*time.Millisecond:
+		return errors.New("witness_stale must be at least 500ms, one block")
+	case t.SignedWindow < 0:
+		return errors.New("signed_window cannot be negative")
+	case t.PrimaryTimeout < 2*time.Second:
+		return errors.New("primary_timeout must be at least 2s, the agent sends a heartbeat every second")
+	}
+	return nil
+}
+
+// tuning holds the current thresholds, they can change when the config is reloaded.
+type tuning struct {
+	mux sync.RWMutex
+	t   thresholds
+}
+
+func newTuning(t thresholds) *tuning {
+	return &tuning{t: t}
+}
+
+// get is safe to call on a nil tuning, returning the defaults
+func (tu *tuning) get() thresholds {
+	if tu == nil {
+		return defaultThresholds()
+	}
+	tu.mux.RLock()
+	defer tu.mux.RUnlock()
+	return tu.t
+}
+
+func (tu *tuning) set(t thresholds) {
+	tu.mux.Lock()
+	tu.t = t
+	tu.mux.Unlock()
+}
+
+// fileConfig is the YAML config file. Anything set on the command line overrides the file. Only the thresholds,
+// notifiers and severities are reloaded on SIGHUP, other changes need a restart.
+type fileConfig struct {
+	Url             string            `yaml:"url"`
+	Account         string            `yaml:"account"`
+	LogFile         string            `yaml:"log_file"`
+	LogSource       string            `yaml:"log_source"`
+	LogMatch        string            `yaml:"log_match"`
+	StateFile       string            `yaml:"state_file"`
+	ForkEndpoints   []string          `yaml:"fork_endpoints"`
+	Witnesses       []string          `yaml:"witnesses"`
+	Quorum          int               `yaml:"quorum"`
+	HeartbeatListen string            `yaml:"heartbeat_listen"`
+	SigningKeys     []string          `yaml:"signing_keys"`
+	NodeosConfig    string            `yaml:"nodeos_config"`
+	Detect          []string          `yaml:"detect"`
+	Notify          []string          `yaml:"notify"`
+	Severity        map[string]string `yaml:"severity"`
+	Thresholds      thresholds        `yaml:"thresholds"`
+}
+
+// loadConfig reads and validates a config file, thresholds that aren't in the file keep their defaults.
+func loadConfig(file string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileConfig{Thresholds: defaultThresholds()}
+	if err = yaml.UnmarshalStrict(b, fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if err = fc.Thresholds.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if fc.Account != "" && len(fc.Account) != 12 {
+		return nil, fmt.Errorf("%s: account should be 12 characters", file)
+	}
+	if fc.LogSource != "" {
+		if _, err = newLogSource(fc.LogSource); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if _, err = newLogMatcher(fc.LogMatch); err != nil {
+		return nil, fmt.Errorf("%s: log_match: %w", file, err)
+	}
+	if _, err = newWitnesses(fc.Witnesses, fc.Quorum, nil); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if _, err = newDetectors(strings.Join(fc.Detect, ",")); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return fc, nil
+}
+
+// needsRestart lists the settings that differ from the running config and can't be reloaded
+func (fc *fileConfig) needsRestart(running *fileConfig) []string {
+	changed := make([]string, 0)
+	if fc.Url != running.Url {
+		changed = append(changed, "url")
+	}
+	if fc.Account != running.Account {
+		changed = append(changed, "account")
+	}
+	if fc.LogFile != running.LogFile {
+		changed = append(changed, "log_file")
+	}
+	if fc.LogSource != running.LogSource {
+		changed = append(changed, "log_source")
+	}
+	if fc.LogMatch != running.LogMatch {
+		changed = append(changed, "log_match")
+	}
+	if fc.StateFile != running.StateFile {
+		changed = append(changed, "state_file")
+	}
+	if strings.Join(fc.ForkEndpoints, ",") != strings.Join(running.ForkEndpoints, ",") {
+		changed = append(changed, "fork_endpoints")
+	}
+	if strings.Join(fc.Witnesses, ",") != strings.Join(running.Witnesses, ",") || fc.Quorum != running.Quorum {
+		changed = append(changed, "witnesses")
+	}
+	if fc.HeartbeatListen != running.HeartbeatListen {
+		changed = append(changed, "heartbeat_listen")
+	}
+	if strings.Join(fc.SigningKeys, ",") != strings.Join(running.SigningKeys, ",") || fc.NodeosConfig != running.NodeosConfig {
+		changed = append(changed, "signing_keys")
+	}
+	if strings.Join(fc.Detect, ",") != strings.Join(running.Detect, ",") {
+		changed = append(changed, "detect")
+	}
+	return changed
+}
+
+// buildNotifiers creates the notifiers from a list of specs, severity overrides are applied in order.
+func buildNotifiers(account string, specs []string, severity ...map[string]string) (*notifiers, error) {
+	n := newNotifiers(account)
+	for _, spec := range specs {
+		if err := n.add(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, sev := range severity {
+		for k, v := range sev {
+			if err := n.setSeverity(k, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// reload re-reads the config file, updating the thresholds and returning new notifiers. Nothing changes if the
+// file is invalid.
+func (cfg *settings) reload() (*notifiers, error) {
+	fc, err := loadConfig(cfg.configFile)
+	if err != nil {
+		return nil, err
+	}
+	n, err := buildNotifiers(string(cfg.account), append(fc.Notify, cfg.notifySpecs...), fc.Severity, cfg.severity)
+	if err != nil {
+		return nil, err
+	}
+	if changed := fc.needsRestart(cfg.config); len(changed) > 0 {
+		log.Printf("changes to %s in %s need a restart, not applied", strings.Join(changed, ", "), cfg.configFile)
+	}
+	cfg.limits.set(fc.Thresholds)
+	return n, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, body string) string {
+	t.Helper()
+	file := filepath.Join(dir, "standby.yml")
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fc, err := loadConfig(writeConfig(t, dir, `
+url: http://10.0.0.1:8888
+account: producer1111
+detect: [order, round]
+notify:
+  - webhook:http://127.0.0.1:1/hook#critical
+severity:
+  enabled: critical
+thresholds:
+  missed_increments: 2
+  schedule_age: 90s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Url != "http://10.0.0.1:8888" || fc.Account != testBp || len(fc.Detect) != 2 || len(fc.Notify) != 1 {
+		t.Error("unexpected config", fc)
+	}
+	want := defaultThresholds()
+	want.MissedIncrements, want.ScheduleAge = 2, 90*time.Second
+	if fc.Thresholds != want {
+		t.Errorf("expected %+v got %+v", want, fc.Thresholds)
+	}
+
+	for _, bad := range []string{
+		"thresholds:\n  missed_increments: 0\n",
+		"thresholds:\n  heartbeat_timeout: 5s\n",
+		"thresholds:\n  schedule_age: soon\n",
+		"account: short\n",
+		"detect: [nope]\n",
+		"unknown_setting: true\n",
+	} {
+		if _, err = loadConfig(writeConfig(t, dir, bad)); err == nil {
+			t.Errorf("expected error loading %q", bad)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &settings{
+		account:     testBp,
+		configFile:  writeConfig(t, dir, "url: http://10.0.0.1:8888\n"),
+		notifySpecs: []string{"slack:http://127.0.0.1:1/slack"},
+		severity:    map[string]string{"paused": "warning"},
+	}
+	cfg.config, err = loadConfig(cfg.configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.limits = newTuning(cfg.config.Thresholds)
+
+	writeConfig(t, dir, `
+url: http://10.0.0.2:8888
+notify: [ "discord:http://127.0.0.1:1/discord" ]
+severity: { paused: error, enabled: critical }
+thresholds: { max_failures: 20 }
+`)
+	n, err := cfg.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.limits.get().MaxFailures != 20 {
+		t.Error("thresholds were not reloaded")
+	}
+	if len(n.routes) != 2 || n.severity[alertEnabled] != "critical" {
+		t.Error("notifiers were not reloaded")
+	}
+	if n.severity[alertPaused] != "warning" {
+		t.Error("command line severity should override the config file")
+	}
+	if changed := cfg.config.needsRestart(&fileConfig{Url: "http://10.0.0.2:8888"}); len(changed) != 1 || changed[0] != "url" {
+		t.Error("url change should need a restart", changed)
+	}
+
+	// a bad file keeps the current settings
+	writeConfig(t, dir, "thresholds: { max_failures: 0 }\n")
+	if _, err = cfg.reload(); err == nil {
+		t.Error("expected error reloading invalid config")
+	}
+	if cfg.limits.get().MaxFailures != 20 {
+		t.Error("thresholds should not change when reload fails")
+	}
+}
+
+func TestOrderDetectorThreshold(t *testing.T) {
+	w := testWatch(nil)
+	w.limits = newTuning(defaultThresholds())
+	d := &orderDetector{interval: time.Second}
+	now := time.Now()
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 10, BlockHeadTime: now})
+
+	missing := func(steps int) bool {
+		for i := 0; i < steps; i++ {
+			now = now.Add(time.Second)
+			evs, _ := d.Step(w, now)
+			for _, ev := range evs {
+				if ev.Kind == eventMissing {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// first step starts the detector and sees the previous producer, then the head has to stall 3 times
+	if missing(3) {
+		t.Fatal("declared missing too early")
+	}
+	if !missing(1) {
+		t.Fatal("should be missing after 3 stalls")
+	}
+
+	// raising the threshold while running takes effect on the next step
+	d = &orderDetector{interval: time.Second}
+	th := defaultThresholds()
+	th.MissedIncrements = 6
+	w.limits.set(th)
+	if missing(6) {
+		t.Fatal("declared missing before the new threshold")
+	}
+	if !missing(1) {
+		t.Fatal("should be missing after 6 stalls")
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventKind is what a Detector is reporting to the main loop.
+type eventKind uint8
+
+const (
+	eventHeartbeat eventKind = iota // the routine is alive
+	eventMissing                    // the primary is not producing, standby should resume
+	eventRestored                   // the primary is producing again, standby should pause
+)
+
+func (k eventKind) String() string {
+	switch k {
+	case eventHeartbeat:
+		return "heartbeat"
+	case eventMissing:
+		return "missing"
+	case eventRestored:
+		return "restored"
+	}
+	return "unknown"
+}
+
+type event struct {
+	Kind   eventKind
+	Source string
+	Reason string
+}
+
+// Detector watches for a single failure (or recovery) condition, and reports it on the events channel. Start is
+// expected to block, it is called as a go routine. A Detector must send heartbeats regularly, if it goes quiet for
+// too long the process exits.
+type Detector interface {
+	Name() string
+	Start(w *watch, events chan<- event, failed chan<- error)
+}
+
+var (
+	detectors        = make(map[string]func() Detector)
+	detectorOrder    = make([]string, 0)
+	detectorDefaults = make([]string, 0)
+)
+
+// registerDetector makes a Detector available by name, and runs it by default. It should be called from init()
+func registerDetector(name string, newDetector func() Detector) {
+	registerOptionalDetector(name, newDetector)
+	detectorDefaults = append(detectorDefaults, name)
+}
+
+// registerOptionalDetector makes a Detector available by name, it only runs if requested.
+func registerOptionalDetector(name string, newDetector func() Detector) {
+	if detectors[name] != nil {
+		panic("detector registered twice: " + name)
+	}
+	detectors[name] = newDetector
+	detectorOrder = append(detectorOrder, name)
+}
+
+// newDetectors builds the detectors in a comma separated list, an empty list gets the defaults.
+func newDetectors(names string) ([]Detector, error) {
+	if names == "" {
+		names = strings.Join(detectorDefaults, ",")
+	}
+	d := make([]Detector, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if detectors[name] == nil {
+			return nil, fmt.Errorf("unknown detector '%s', valid options are: %s", name, strings.Join(detectorOrder, ", "))
+		}
+		d = append(d, detectors[name]())
+	}
+	return d, nil
+}
+
+func init() {
+	registerDetector("order", func() Detector { return &orderDetector{interval: time.Second} })
+	registerDetector("round", func() Detector { return &roundDetector{interval: 6 * time.Second} })
+	registerDetector("dupsig", func() Detector { return &duplicateDetector{interval: time.Minute} })
+}
+
+// chainReader is the subset of *fio.API used by detectors, allows substituting a fake in tests.
+type chainReader interface {
+	GetBlockByNum(num uint32) (*eos.BlockResp, error)
+	GetBlockHeaderState(numOrId interface{}) (*fio.BlockHeaderState, error)
+}
+
+// watch holds the shared state detectors need.
+type watch struct {
+	account   eos.AccountName
+	api       chainReader
+	head      *chainHead
+	neighbors *neighbor
+	isPaused  func() bool
+	logs      *logHub         // nodeos log, nil if not following it
+	match     *logMatcher     // finds duplicate blocks in the log, nil uses the default
+	peers     []chainReader   // independent api endpoints
+	limits    *tuning         // current thresholds, nil uses the defaults
+	primary   *primaryWatch   // heartbeats from the primary's agent, nil if not listening
+	stop      <-chan struct{} // closed when the main loop returns, nil runs forever
+}
+
+// send passes an event to the main loop, it returns false if the loop has stopped and the routine should return.
+func (w *watch) send(events chan<- event, ev event) bool {
+	select {
+	case events <- ev:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// fail reports an error to the main loop, it returns false if the loop has stopped.
+func (w *watch) fail(failed chan<- error, err error) bool {
+	select {
+	case failed <- err:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+type neighbor struct {
+	mux    sync.RWMutex
+	Before string
+	After  string
+
+	versions map[uint32]scheduleNeighbors // tracked active and pending schedules, see schedule.go
+}
+
+func (n *neighbor) get() (before string, after string) {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.Before, n.After
+}
+
+func (n *neighbor) set(before string, after string) {
+	n.mux.Lock()
+	n.Before, n.After = before, after
+	n.mux.Unlock()
+}
+
+type blockNumProd struct {
+	Producer        string    `json:"producer"`
+	BlockNum        uint32    `json:"block_num"`
+	BlockHeadTime   time.Time `json:"block_head_time"`
+	ScheduleVersion uint32    `json:"schedule_version"`
+}
+
+func (b blockNumProd) syncing() bool {
+	return b.syncingAt(time.Now())
+}
+
+func (b blockNumProd) syncingAt(now time.Time) bool {
+	if b.BlockHeadTime.Before(now.Add(-time.Minute)) {
+		return true
+	}
+	return false
+}
+
+// chainHead holds the most recent block, it's shared so multiple routines aren't hammering the endpoint.
+type chainHead struct {
+	mux   sync.RWMutex
+	block blockNumProd
+}
+
+func (h *chainHead) get() blockNumProd {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.block
+}
+
+func (h *chainHead) set(b blockNumProd) {
+	h.mux.Lock()
+	h.block = b
+	h.mux.Unlock()
+}
+
+// stepper is a Detector that does all of its work on a fixed interval. Keeping the work in Step, and the state in
+// the Detector, allows driving it with a virtual clock when replaying a recording.
+type stepper interface {
+	Detector
+	Interval() time.Duration
+	Step(w *watch, now time.Time) ([]event, error)
+}
+
+// lineWatcher is a Detector that inspects nodeos log lines, Line is called for each one.
+type lineWatcher interface {
+	Detector
+	Line(w *watch, text string) []event
+}
+
+// runSteps drives a stepper using the wall clock, until the watch is stopped.
+func runSteps(d stepper, w *watch, events chan<- event, failed chan<- error) {
+	t := time.NewTicker(d.Interval())
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-w.stop:
+			return
+		}
+		evs, err := d.Step(w, now)
+		if err != nil && !w.fail(failed, err) {
+			return
+		}
+		for _, ev := range evs {
+			if !w.send(events, ev) {
+				return
+			}
+		}
+	}
+}
+
+// orderDetector expects blocks from our account before or after neighbors based on sorting in the schedule. If head
+// is not incrementing, and the previous producer is immediately before this bp, it is missing blocks.
+type orderDetector struct {
+	interval time.Duration
+
+	started       bool
+	waiting       time.Time
+	produced      bool
+	wereNext      bool
+	missedCounter int
+	lastBlock     uint32
+	version       uint32 // schedule version of the last block
+}
+
+func (d *orderDetector) Name() string {
+	return "missed blocks"
+}
+
+func (d *orderDetector) Interval() time.Duration {
+	return d.interval
+}
+
+func (d *orderDetector) Start(w *watch, events chan<- event, failed chan<- error) {
+	runSteps(d, w, events, failed)
+}
+
+func (d *orderDetector) Step(w *watch, now time.Time) ([]event, error) {
+	block := w.head.get()
+	if !d.started {
+		if _, _, scheduled := w.neighbors.at(block.ScheduleVersion); !scheduled || block.syncingAt(now) {
+			if now.Sub(d.waiting) >= 5*d.interval {
+				log.Println("missed block detection not started, waiting for data")
+				d.waiting = now
+			}
+			return nil, nil
+		}
+		log.Println("watching for missed blocks")
+		d.started = true
+		d.lastBlock = block.BlockNum - 1
+	}
+	if block.syncingAt(now) {
+		return nil, nil
+	}
+	evs := []event{{Kind: eventHeartbeat, Source: d.Name()}}
+	if !w.isPaused() {
+		return evs, nil
+	}
+	// the order changes with the schedule, start over on the block where a new schedule takes effect
+	before, after, scheduled := w.neighbors.at(block.ScheduleVersion)
+	if block.ScheduleVersion != d.version || !scheduled {
+		if d.version != 0 && block.ScheduleVersion != d.version {
+			log.Printf("schedule version %d is active at block %d, neighbors are %s and %s", block.ScheduleVersion, block.BlockNum, before, after)
+		}
+		d.version = block.ScheduleVersion
+		d.wereNext, d.produced, d.missedCounter = false, false, 0
+	}
+	if !scheduled {
+		// not in the schedule that produced this block, nothing to miss
+		d.lastBlock = block.BlockNum
+		return evs, nil
+	}
+	switch block.Producer {
+	case before:
+		d.wereNext = true
+		d.produced = false
+	case string(w.account):
+		d.wereNext = false
+		d.produced = true
+		d.missedCounter = 0
+	case after:
+		if !d.produced && d.wereNext {
+			// missed the entire round!
+			log.Printf("%s was scheduled to be next, but did not produce\n", w.account)
+			evs = append(evs, event{Kind: eventMissing, Source: d.Name(), Reason: "has missed blocks."})
+			d.wereNext = false
+		}
+	}
+	if block.BlockNum == d.lastBlock {
+		log.Println("block not incrementing", d.lastBlock, "last producer", block.Producer)
+		if d.wereNext {
+			d.missedCounter += 1
+		}
+	}
+	d.lastBlock = block.BlockNum
+	// by default this would be 4 missed blocks
+	if limit := w.limits.get().MissedIncrements; d.missedCounter >= limit {
+		log.Printf("head block failed to increment %d times during the schedule for %s, declaring as missing", limit, w.account)
+		evs = append(evs, event{Kind: eventMissing, Source: d.Name(), Reason: "has missed blocks."})
+		d.wereNext = false
+	}
+	return evs, nil
+}
+
+// roundDetector is a fallback for orderDetector, which may not be reliable if multiple producers are missing rounds.
+// It should find if this producer is missing entire rounds based on reversible block states. Not ideal, but beats
+// missing many rounds instead of just one.
+type roundDetector struct {
+	interval time.Duration
+
+	started         bool
+	skipUntil       time.Time
+	lastScheduleLib uint32
+}
+
+func (d *roundDetector) Name() string {
+	return "missed rounds"
+}
+
+func (d *roundDetector) Interval() time.Duration {
+	return d.interval
+}
+
+func (d *roundDetector) Start(w *watch, events chan<- event, failed chan<- error) {
+	runSteps(d, w, events, failed)
+}
+
+func (d *roundDetector) Step(w *watch, now time.Time) ([]event, error) {
+	block := w.head.get()
+	if !d.started {
+		if block.syncingAt(now) {
+			log.Println("missed round detection not started, waiting for data")
+			return nil, nil
+		}
+		log.Println("watching for missed rounds")
+		d.started = true
+	}
+
+	evs := []event{{Kind: eventHeartbeat, Source: d.Name()}}
+	if !w.isPaused() || now.Before(d.skipUntil) {
+		return evs, nil
+	}
+	limits := w.limits.get()
+
+	bhs, err := w.api.GetBlockHeaderState(block.BlockNum)
+	if err != nil {
+		return evs, err
+	}
+	if bhs.PendingSchedule == nil || block.syncingAt(now) {
+		// may not be synced
+		d.skipUntil = now.Add(10 * d.interval)
+		return evs, nil
+	}
+	// ensure at least a full round on this schedule before checking
+	if bhs.PendingSchedule.ScheduleLibNum != d.lastScheduleLib {
+		gsb, err := w.api.GetBlockByNum(bhs.PendingSchedule.ScheduleLibNum)
+		if err != nil {
+			return evs, err
+		}
+		if now.Before(gsb.SignedBlockHeader.Timestamp.Time.Add(limits.ScheduleAge)) {
+			// not long enough to declare missing....
+			return evs, nil
+		}
+		d.lastScheduleLib = bhs.PendingSchedule.ScheduleLibNum
+	}
+	if ok, lp := bhs.ProducerToLast(fio.ProducerToLastProduced); ok {
+		for _, prod := range lp {
+			if string(prod.Producer) == string(w.account) && prod.BlockNum+limits.MissedRoundBlocks < block.BlockNum {
+				log.Printf("detected %s has missed a round, last produced on %d, %d blocks ago\n", w.account, prod.BlockNum, block.BlockNum-prod.BlockNum)
+				evs = append(evs, event{Kind: eventMissing, Source: d.Name(), Reason: "has missed a round."})
+			}
+		}
+	}
+	return evs, nil
+}
+
+// duplicateDetector watches the nodeos stdout logs for duplicate blocks by the same producer, these will be rejected
+// with a 'Block not applied to head' error. This isn't a 100% guarantee that there aren't two active nodes
+// producing blocks with the same key, if a block is empty both producers will create identical blocks. This should
+// catch it pretty quick though.
+type duplicateDetector struct {
+	interval time.Duration
+}
+
+func (d *duplicateDetector) Name() string {
+	return "log watcher"
+}
+
+func (d *duplicateDetector) Line(w *watch, text string) []event {
+	match := w.match
+	if match == nil {
+		match, _ = newLogMatcher("")
+	}
+	if account := match.account(text); account != "" && account == string(w.account) {
+		log.Println(account, "produced a duplicate block")
+		return []event{{Kind: eventRestored, Source: d.Name(), Reason: "produced a duplicate block"}}
+	}
+	return nil
+}
+
+func (d *duplicateDetector) Start(w *watch, events chan<- event, failed chan<- error) {
+	if w.logs == nil {
+		w.fail(failed, errors.New("log watcher has no log source"))
+		return
+	}
+	lines := w.logs.subscribe(failed, w.stop)
+
+	healthTick := time.NewTicker(d.interval)
+	defer healthTick.Stop()
+	var last time.Time
+
+	for {
+		select {
+		case line := <-lines:
+			for _, ev := range d.Line(w, line.Text) {
+				if !w.send(events, ev) {
+					return
+				}
+			}
+			last = line.Time
+
+		case <-healthTick.C:
+			// only healthy if the log is moving, nodeos logs every block
+			if last.After(time.Now().Add(-d.interval)) && !w.send(events, event{Kind: eventHeartbeat, Source: d.Name()}) {
+				return
+			}
+
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// sortedNeighbors finds the producers immediately before and after prod in the (sorted) schedule.
+func sortedNeighbors(prods []string, prod string) (before string, after string, found bool) {
+	sorted := make([]string, len(prods))
+	copy(sorted, prods)
+	sort.Strings(sorted)
+	for i, p := range sorted {
+		if p != prod {
+			continue
+		}
+		switch i {
+		case 0:
+			before = sorted[len(sorted)-1]
+		default:
+			before = sorted[i-1]
+		}
+		switch i {
+		case len(sorted) - 1:
+			after = sorted[0]
+		default:
+			after = sorted[i+1]
+		}
+		return before, after, true
+	}
+	return
+}
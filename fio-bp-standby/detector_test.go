@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testBp = "producer1111"
+
+// fakeChain satisfies chainReader
+type fakeChain struct {
+	bhs   *fio.BlockHeaderState
+	block *eos.BlockResp
+}
+
+func (f *fakeChain) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+	if f.block == nil {
+		return nil, fmt.Errorf("block %d not found", num)
+	}
+	return f.block, nil
+}
+
+func (f *fakeChain) GetBlockHeaderState(numOrId interface{}) (*fio.BlockHeaderState, error) {
+	if f.bhs == nil {
+		return nil, fmt.Errorf("block %v not found", numOrId)
+	}
+	return f.bhs, nil
+}
+
+func testWatch(api chainReader) *watch {
+	w := &watch{
+		account:   testBp,
+		api:       api,
+		head:      &chainHead{},
+		neighbors: &neighbor{},
+		isPaused:  func() bool { return true },
+	}
+	w.neighbors.set("aproducer111", "zproducer111")
+	return w
+}
+
+// waitFor drains events until one of kind arrives, or times out
+func waitFor(t *testing.T, events chan event, failed chan error, kind eventKind, timeout time.Duration) (event, bool) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == kind {
+				return ev, true
+			}
+		case err := <-failed:
+			t.Log(err)
+		case <-deadline:
+			return event{}, false
+		}
+	}
+}
+
+func TestNewDetectors(t *testing.T) {
+	d, err := newDetectors("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != len(detectorDefaults) {
+		t.Errorf("expected %d detectors, got %d", len(detectorDefaults), len(d))
+	}
+	d, err = newDetectors("order, round")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 2 {
+		t.Errorf("expected 2 detectors, got %d", len(d))
+	}
+	if _, err = newDetectors("order,nope"); err == nil {
+		t.Error("expected error for unknown detector")
+	}
+}
+
+func TestSortedNeighbors(t *testing.T) {
+	prods := []string{"ccc", "aaa", "ddd", "bbb"}
+	for _, tc := range []struct {
+		prod, before, after string
+		found               bool
+	}{
+		{"aaa", "ddd", "bbb", true},
+		{"ddd", "ccc", "aaa", true},
+		{"bbb", "aaa", "ccc", true},
+		{"eee", "", "", false},
+	} {
+		before, after, found := sortedNeighbors(prods, tc.prod)
+		if before != tc.before || after != tc.after || found != tc.found {
+			t.Errorf("%s: expected %s %s %v got %s %s %v", tc.prod, tc.before, tc.after, tc.found, before, after, found)
+		}
+	}
+	if before, after, _ := sortedNeighbors([]string{"aaa"}, "aaa"); before != "aaa" || after != "aaa" {
+		t.Error("single producer schedule should be its own neighbor")
+	}
+}
+
+func TestOrderDetector(t *testing.T) {
+	w := testWatch(nil)
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 10, BlockHeadTime: time.Now()})
+	events, failed := make(chan event), make(chan error)
+	go (&orderDetector{interval: 10 * time.Millisecond}).Start(w, events, failed)
+
+	if _, ok := waitFor(t, events, failed, eventHeartbeat, time.Second); !ok {
+		t.Fatal("did not get heartbeat")
+	}
+	// head is stuck on the producer before us, should declare missing
+	ev, ok := waitFor(t, events, failed, eventMissing, time.Second)
+	if !ok {
+		t.Fatal("missed blocks were not detected")
+	}
+	if ev.Source != "missed blocks" {
+		t.Error("unexpected event source", ev.Source)
+	}
+}
+
+func TestOrderDetectorProducing(t *testing.T) {
+	w := testWatch(nil)
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 10, BlockHeadTime: time.Now()})
+	events, failed := make(chan event), make(chan error)
+	go (&orderDetector{interval: 10 * time.Millisecond}).Start(w, events, failed)
+
+	stop := time.After(500 * time.Millisecond)
+	var n uint32 = 11
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == eventMissing {
+				t.Fatal("should not be missing when producing")
+			}
+			// our turn to produce, head keeps moving
+			w.head.set(blockNumProd{Producer: testBp, BlockNum: n, BlockHeadTime: time.Now()})
+			n += 1
+		case <-stop:
+			return
+		}
+	}
+}
+
+func TestRoundDetector(t *testing.T) {
+	lastProduced, _ := json.Marshal([]interface{}{testBp, 100})
+	fc := &fakeChain{
+		bhs: &fio.BlockHeaderState{
+			PendingSchedule:        &fio.PendingSchedule{ScheduleLibNum: 50},
+			ProducerToLastProduced: []json.RawMessage{lastProduced},
+		},
+		block: &eos.BlockResp{},
+	}
+	fc.block.Timestamp = eos.BlockTimestamp{Time: time.Now().Add(-time.Hour)}
+
+	w := testWatch(fc)
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 1000, BlockHeadTime: time.Now(), ScheduleVersion: 2})
+	events, failed := make(chan event), make(chan error)
+	go (&roundDetector{interval: 10 * time.Millisecond}).Start(w, events, failed)
+
+	if _, ok := waitFor(t, events, failed, eventMissing, time.Second); !ok {
+		t.Fatal("missed round was not detected")
+	}
+}
+
+func TestRoundDetectorRecentSchedule(t *testing.T) {
+	lastProduced, _ := json.Marshal([]interface{}{testBp, 100})
+	fc := &fakeChain{
+		bhs: &fio.BlockHeaderState{
+			PendingSchedule:        &fio.PendingSchedule{ScheduleLibNum: 50},
+			ProducerToLastProduced: []json.RawMessage{lastProduced},
+		},
+		block: &eos.BlockResp{},
+	}
+	// schedule is too new to declare a missed round
+	fc.block.Timestamp = eos.BlockTimestamp{Time: time.Now()}
+
+	w := testWatch(fc)
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 1000, BlockHeadTime: time.Now(), ScheduleVersion: 2})
+	events, failed := make(chan event), make(chan error)
+	go (&roundDetector{interval: 10 * time.Millisecond}).Start(w, events, failed)
+
+	if _, ok := waitFor(t, events, failed, eventMissing, 200*time.Millisecond); ok {
+		t.Fatal("should not detect a missed round on a new schedule")
+	}
+}
+
+func TestDuplicateDetector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := testWatch(nil)
+	logFile := filepath.Join(dir, "nodeos.log")
+	if err = ioutil.WriteFile(logFile, []byte("starting\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.logs = newLogHub(&fileSource{path: logFile, poll: 10 * time.Millisecond})
+
+	events, failed := make(chan event), make(chan error)
+	go (&duplicateDetector{interval: time.Second}).Start(w, events, failed)
+	time.Sleep(100 * time.Millisecond)
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, _ = f.WriteString("error 2021-01-01T00:00:00.000 nodeos controller.cpp:1 Block not applied to head 123 signed by someoneelse1\n")
+	_, _ = f.WriteString("error 2021-01-01T00:00:00.500 nodeos controller.cpp:1 Block not applied to head 124 signed by " + testBp + "\n")
+
+	ev, ok := waitFor(t, events, failed, eventRestored, 2*time.Second)
+	if !ok {
+		t.Fatal("duplicate block was not detected")
+	}
+	if ev.Source != "log watcher" {
+		t.Error("unexpected event source", ev.Source)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fioprotocol/fio-go/eos"
+)
+
+func init() {
+	registerOptionalDetector("fork", func() Detector { return &forkDetector{interval: 2 * time.Second} })
+}
+
+// forkDetector finds duplicate production without access to the nodeos log. It compares the blocks signed by our
+// producer on the local node against the same heights on independent API endpoints, if two nodes are signing with
+// the same key the network forks, and at least one of the endpoints will have a different block id for a height
+// that was signed by us. It only runs while producing, and has to look at reversible blocks before the losing
+// fork is discarded, so endpoints should be close to the head.
+type forkDetector struct {
+	interval time.Duration
+
+	next     uint32 // next height to compare
+	warned   bool
+	failing  map[int]bool     // endpoints that failed on the last request, only changes are logged
+	retry    map[int][]uint32 // heights signed by us that a lagging endpoint hasn't returned yet
+	degraded bool             // no endpoint answered, forks can't be seen
+}
+
+// how far back to look, 2 rounds worth of our blocks is more than enough.
+const forkWindow = 24
+
+func (d *forkDetector) Name() string {
+	return "fork watcher"
+}
+
+func (d *forkDetector) Interval() time.Duration {
+	return d.interval
+}
+
+func (d *forkDetector) Start(w *watch, events chan<- event, failed chan<- error) {
+	runSteps(d, w, events, failed)
+}
+
+func (d *forkDetector) Step(w *watch, now time.Time) ([]event, error) {
+	evs := []event{{Kind: eventHeartbeat, Source: d.Name()}}
+	if len(w.peers) == 0 {
+		if !d.warned {
+			log.Println("fork detection needs at least one independent endpoint, it will not run")
+			d.warned = true
+		}
+		return evs, nil
+	}
+	head := w.head.get()
+	if w.isPaused() || head.syncingAt(now) {
+		d.next = 0
+		d.retry = nil
+		return evs, nil
+	}
+	if d.next == 0 || d.next+forkWindow < head.BlockNum || d.next > head.BlockNum+1 {
+		d.retry = nil
+		d.next = 1
+		if head.BlockNum > forkWindow {
+			d.next = head.BlockNum - forkWindow
+		}
+	}
+	if d.failing == nil {
+		d.failing = make(map[int]bool)
+	}
+	if d.retry == nil {
+		d.retry = make(map[int][]uint32)
+	}
+
+	// endpoints that were behind get another look at the heights they missed
+	for i := range w.peers {
+		ev, err := d.recheck(w, i, head.BlockNum)
+		if err != nil || ev != nil {
+			if ev != nil {
+				evs = append(evs, *ev)
+			}
+			return evs, err
+		}
+	}
+
+	for ; d.next <= head.BlockNum; d.next++ {
+		local, err := getBlock(w.api, d.next)
+		if err != nil {
+			return evs, err
+		}
+		if string(local.Producer) != string(w.account) {
+			continue
+		}
+		var behind []int
+		for i, peer := range w.peers {
+			b, err := getBlock(peer, d.next)
+			d.peerFailed(i, err)
+			if err != nil {
+				behind = append(behind, i)
+				continue
+			}
+			if ev := d.compare(w, i, local, b); ev != nil {
+				d.setDegraded(false, d.next)
+				d.next += 1
+				return append(evs, *ev), nil
+			}
+		}
+		d.setDegraded(len(behind) == len(w.peers), d.next)
+		if d.degraded {
+			// nothing to compare against, try the same height next time
+			return evs, nil
+		}
+		for _, i := range behind {
+			d.retry[i] = append(d.retry[i], d.next)
+		}
+	}
+	return evs, nil
+}
+
+// recheck compares the heights an endpoint failed to return earlier, stopping at the first one it still doesn't
+// have. Heights that have fallen out of the window are dropped, the losing fork is gone by then.
+func (d *forkDetector) recheck(w *watch, i int, head uint32) (*event, error) {
+	heights := d.retry[i]
+	defer func() { d.retry[i] = heights }()
+	for len(heights) > 0 {
+		if heights[0]+forkWindow < head {
+			heights = heights[1:]
+			continue
+		}
+		b, err := getBlock(w.peers[i], heights[0])
+		d.peerFailed(i, err)
+		if err != nil {
+			return nil, nil
+		}
+		local, err := getBlock(w.api, heights[0])
+		if err != nil {
+			return nil, err
+		}
+		heights = heights[1:]
+		if ev := d.compare(w, i, local, b); ev != nil {
+			return ev, nil
+		}
+	}
+	return nil, nil
+}
+
+// compare returns a restored event if an endpoint has a different block signed by us at the same height
+func (d *forkDetector) compare(w *watch, i int, local, b *eos.BlockResp) *event {
+	if string(b.Producer) != string(w.account) || b.ID.String() == local.ID.String() {
+		return nil
+	}
+	log.Printf("%s signed two different blocks at height %d: %s locally, %s on endpoint %d", w.account, local.BlockNum, local.ID.String(), b.ID.String(), i+1)
+	return &event{
+		Kind:   eventRestored,
+		Source: d.Name(),
+		Reason: fmt.Sprintf("signed conflicting blocks at height %d", local.BlockNum),
+	}
+}
+
+// getBlock treats a missing block as an error, a node that is behind may answer without one
+func getBlock(r chainReader, height uint32) (*eos.BlockResp, error) {
+	b, err := r.GetBlockByNum(height)
+	if err == nil && b == nil {
+		err = fmt.Errorf("block %d not found", height)
+	}
+	return b, err
+}
+
+// peerFailed counts an endpoint's errors, logging when it starts or stops failing
+func (d *forkDetector) peerFailed(i int, err error) {
+	if err != nil {
+		stats.forkPeerError(i + 1)
+	}
+	switch {
+	case err != nil && !d.failing[i]:
+		log.Printf("fork watcher: endpoint %d failed, will retry: %v", i+1, err)
+	case err == nil && d.failing[i]:
+		log.Printf("fork watcher: endpoint %d is answering again", i+1)
+	}
+	d.failing[i] = err != nil
+}
+
+// setDegraded records if forks can be detected at all, with no endpoint answering a fork would go unnoticed.
+func (d *forkDetector) setDegraded(degraded bool, height uint32) {
+	if degraded != d.degraded {
+		if degraded {
+			log.Printf("fork detection is degraded, no endpoint returned block %d", height)
+		} else {
+			log.Println("fork detection recovered, endpoints are answering")
+		}
+	}
+	d.degraded = degraded
+	stats.setForkDegraded(degraded)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// blockMap is a chainReader with a fixed set of blocks
+type blockMap map[uint32]*eos.BlockResp
+
+func (m blockMap) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+	if m[num] == nil {
+		return nil, fmt.Errorf("block %d not found", num)
+	}
+	return m[num], nil
+}
+
+func (m blockMap) GetBlockHeaderState(numOrId interface{}) (*fio.BlockHeaderState, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func testBlocks(from, to uint32, id byte) blockMap {
+	m := make(blockMap)
+	for i := from; i <= to; i++ {
+		b := &eos.BlockResp{BlockNum: i, ID: eos.Checksum256{id, byte(i)}}
+		b.Producer = "aproducer111"
+		if i%24 < 12 {
+			b.Producer = testBp
+		}
+		m[i] = b
+	}
+	return m
+}
+
+func TestForkDetector(t *testing.T) {
+	local := testBlocks(1, 100, 1)
+	peer := testBlocks(1, 100, 1)
+	w := testWatch(local)
+	w.peers = []chainReader{peer}
+	w.isPaused = func() bool { return false }
+	w.head.set(blockNumProd{BlockNum: 100, BlockHeadTime: time.Now()})
+	d := &forkDetector{interval: time.Second}
+
+	evs, err := d.Step(w, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 || evs[0].Kind != eventHeartbeat {
+		t.Fatal("identical chains should not report a fork", evs)
+	}
+
+	// the primary came back and signed a different block at 98
+	peer[98] = &eos.BlockResp{BlockNum: 98, ID: eos.Checksum256{2, 98}}
+	peer[98].Producer = testBp
+	local[101] = &eos.BlockResp{BlockNum: 101, ID: eos.Checksum256{1, 101}}
+	peer[101] = local[101]
+	w.head.set(blockNumProd{BlockNum: 101, BlockHeadTime: time.Now()})
+	d.next = 98
+	evs, err = d.Step(w, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 2 || evs[1].Kind != eventRestored {
+		t.Fatal("conflicting blocks signed by our producer should be reported", evs)
+	}
+}
+
+func TestForkDetectorPaused(t *testing.T) {
+	local := testBlocks(1, 100, 1)
+	w := testWatch(local)
+	w.peers = []chainReader{testBlocks(1, 100, 2)}
+	w.head.set(blockNumProd{BlockNum: 100, BlockHeadTime: time.Now()})
+	evs, _ := (&forkDetector{interval: time.Second}).Step(w, time.Now())
+	if len(evs) != 1 {
+		t.Fatal("should not check for forks while paused", evs)
+	}
+}
+
+func TestForkDetectorEndpoints(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	forkErrors := func() (uint64, uint64, bool) {
+		stats.mux.Lock()
+		defer stats.mux.Unlock()
+		return stats.forkErrors[1], stats.forkErrors[2], stats.forkDegraded
+	}
+	first, second, _ := forkErrors()
+
+	// near genesis the window starts at the first block
+	local := testBlocks(1, 10, 1)
+	w := testWatch(local)
+	w.peers = []chainReader{testBlocks(1, 10, 1)}
+	w.isPaused = func() bool { return false }
+	w.head.set(blockNumProd{BlockNum: 10, BlockHeadTime: time.Now()})
+	d := &forkDetector{interval: time.Second}
+	if _, err := d.Step(w, time.Now()); err != nil || d.next != 11 {
+		t.Fatal("expected blocks 1 to 10 to be compared, next is", d.next, err)
+	}
+
+	// no endpoint answers, degraded and not advancing
+	w.peers = []chainReader{blockMap{}, blockMap{}}
+	local[11] = &eos.BlockResp{BlockNum: 11, ID: eos.Checksum256{1, 11}}
+	local[11].Producer = testBp
+	w.head.set(blockNumProd{BlockNum: 11, BlockHeadTime: time.Now()})
+	if _, err := d.Step(w, time.Now()); err != nil || !d.degraded || d.next != 11 {
+		t.Fatal("expected fork detection to be degraded at block 11", d.degraded, d.next, err)
+	}
+	if e1, e2, degraded := forkErrors(); e1 != first+1 || e2 != second+1 || !degraded {
+		t.Error("endpoint errors were not counted", e1-first, e2-second, degraded)
+	}
+
+	// one answers, a fork it sees is still reported and it is no longer degraded
+	conflict := blockMap{11: &eos.BlockResp{BlockNum: 11, ID: eos.Checksum256{2, 11}}}
+	conflict[11].Producer = testBp
+	w.peers = []chainReader{blockMap{}, conflict}
+	evs, err := d.Step(w, time.Now())
+	if err != nil || len(evs) != 2 || evs[1].Kind != eventRestored || d.degraded {
+		t.Fatal("expected the fork to be reported by the endpoint that answered", evs, d.degraded, err)
+	}
+
+	// an endpoint that stays down doesn't hold the others back
+	local = testBlocks(1, 60, 1)
+	w = testWatch(local)
+	w.peers = []chainReader{blockMap{}, testBlocks(1, 60, 1)}
+	w.isPaused = func() bool { return false }
+	w.head.set(blockNumProd{BlockNum: 40, BlockHeadTime: time.Now()})
+	d = &forkDetector{interval: time.Second}
+	if evs, err = d.Step(w, time.Now()); err != nil || len(evs) != 1 || d.next != 41 || d.degraded {
+		t.Fatal("expected blocks 16 to 40 to be compared with one endpoint down", evs, d.next, d.degraded, err)
+	}
+	if len(d.retry[0]) == 0 || len(d.retry[1]) != 0 {
+		t.Fatal("only the failing endpoint should have heights to retry", d.retry)
+	}
+
+	// once it catches up the heights it missed are compared
+	lagging := testBlocks(1, 60, 1)
+	lagging[34] = &eos.BlockResp{BlockNum: 34, ID: eos.Checksum256{2, 34}}
+	lagging[34].Producer = testBp
+	w.peers[0] = lagging
+	if evs, err = d.Step(w, time.Now()); err != nil || len(evs) != 2 || evs[1].Kind != eventRestored {
+		t.Fatal("expected the fork at 34 to be found when the endpoint caught up", evs, err)
+	}
+
+	// a fork at a later height is still reported while the first endpoint stays down
+	w.peers[0] = blockMap{}
+	forked := testBlocks(1, 60, 1)
+	forked[50] = &eos.BlockResp{BlockNum: 50, ID: eos.Checksum256{2, 50}}
+	forked[50].Producer = testBp
+	w.peers[1] = forked
+	w.head.set(blockNumProd{BlockNum: 60, BlockHeadTime: time.Now()})
+	if evs, err = d.Step(w, time.Now()); err != nil || len(evs) != 2 || evs[1].Kind != eventRestored || d.next != 51 {
+		t.Fatal("expected the fork at 50 to be reported", evs, d.next, err)
+	}
+	for _, h := range d.retry[0] {
+		if h+forkWindow < 60 {
+			t.Error("heights outside the window should not be retried", d.retry[0])
+			break
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fioprotocol/fio-go/eos"
+	"time"
+)
+
+// The duplicate block detectors only pause after both nodes have signed, by then there is already a fork. Before
+// resuming, the standby looks for blocks our producer signed in the last few seconds. Finding one means the primary
+// is alive and the detection was a false positive. Only recent blocks count: if the primary stopped part way
+// through its turn its earlier blocks should not hold up the failover.
+
+// signedRecently returns an error if the account signed a block less than window before now. The block header state
+// is checked first, then the last blocks from the head, one for each 500ms slot in the window.
+func signedRecently(api witnessReader, account eos.AccountName, window time.Duration, now time.Time) error {
+	if window <= 0 {
+		return nil
+	}
+	info, err := api.GetInfo()
+	if err != nil {
+		return err
+	}
+	head := info.HeadBlockNum
+	blocks := uint32(window/(500*time.Millisecond)) + 1
+	if blocks > head {
+		blocks = head
+	}
+	recent := func(num uint32) error {
+		block, err := api.GetBlockByNum(num)
+		if err != nil {
+			return err
+		}
+		if block.Producer == account && now.Sub(block.Timestamp.Time) < window {
+			return fmt.Errorf("%s signed block %d %v ago", account, num, now.Sub(block.Timestamp.Time).Round(100*time.Millisecond))
+		}
+		return nil
+	}
+
+	distance, err := lastProduced(api, account, head)
+	if err != nil {
+		return err
+	}
+	if distance >= 0 && distance < int64(head) {
+		if err = recent(head - uint32(distance)); err != nil {
+			return fmt.Errorf("block header state: %w", err)
+		}
+	}
+	for num := head; num > head-blocks; num-- {
+		if err = recent(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
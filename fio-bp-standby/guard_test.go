@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedChain is a witnessReader with a block for every number up to head, signed by producer
+type signedChain struct {
+	head     uint32
+	headTime time.Time
+	producer map[uint32]string
+	last     uint32 // our last produced block in the block header state
+}
+
+func (c *signedChain) GetInfo() (*eos.InfoResp, error) {
+	return &eos.InfoResp{HeadBlockNum: c.head, HeadBlockTime: eos.JSONTime{Time: c.headTime}}, nil
+}
+
+func (c *signedChain) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+	if num > c.head {
+		return nil, fmt.Errorf("block %d not found", num)
+	}
+	b := &eos.BlockResp{BlockNum: num}
+	b.Producer = eos.AccountName(c.producer[num])
+	b.Timestamp.Time = c.headTime.Add(-time.Duration(c.head-num) * 500 * time.Millisecond)
+	return b, nil
+}
+
+func (c *signedChain) GetBlockHeaderState(numOrId interface{}) (*fio.BlockHeaderState, error) {
+	lp, _ := json.Marshal([]interface{}{testBp, c.last})
+	return &fio.BlockHeaderState{ProducerToLastProduced: []json.RawMessage{lp}}, nil
+}
+
+func TestSignedRecently(t *testing.T) {
+	now := time.Now()
+	c := &signedChain{head: 1000, headTime: now.Add(-time.Second), producer: make(map[uint32]string), last: 990}
+	for i := uint32(990); i <= 1000; i++ {
+		c.producer[i] = "aproducer111"
+	}
+	c.producer[990] = testBp
+
+	// ours was 5.5 seconds ago, the primary stopped
+	if err := signedRecently(c, testBp, 3*time.Second, now); err != nil {
+		t.Error(err)
+	}
+
+	// primary signed the head a moment ago
+	c.producer[1000], c.last = testBp, 1000
+	if err := signedRecently(c, testBp, 3*time.Second, now); err == nil || !strings.Contains(err.Error(), "block 1000") {
+		t.Error("expected the head block to be found, got", err)
+	}
+
+	// head stalled on our block, it gets older
+	if err := signedRecently(c, testBp, 3*time.Second, now.Add(3*time.Second)); err != nil {
+		t.Error("stalled on our block for 4s should not be recent:", err)
+	}
+
+	// found in the blocks even if the block header state doesn't list it
+	c.last = 990
+	c.producer[999] = testBp
+	if err := signedRecently(c, testBp, 3*time.Second, now); err == nil || strings.Contains(err.Error(), "block header state") {
+		t.Error("expected the block scan to find block 1000, got", err)
+	}
+
+	if err := signedRecently(c, testBp, 0, now); err != nil {
+		t.Error("a window of 0 should skip the check")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"log"
+	"time"
+)
+
+// A planned handover moves production between the primary and the standby for maintenance. Production can only be
+// moved safely between our slots: it waits until the producing node has signed the last block of our slot (the next
+// producer's block is on the head), pauses it, and resumes the other node. Our next slot is a full round away, two
+// minutes with 21 producers, so there is plenty of time to switch without missing a block or both nodes signing.
+
+// infoReader is the subset of *fio.API used to follow the head during a handover
+type infoReader interface {
+	GetInfo() (*eos.InfoResp, error)
+}
+
+// handoverNode is one side of a handover
+type handoverNode struct {
+	name     string
+	api      infoReader
+	producer producerSwitch
+}
+
+type handover struct {
+	account eos.AccountName
+	from    *handoverNode
+	to      *handoverNode
+	poll    time.Duration
+	timeout time.Duration // how long to wait for our slot, and for the new node to produce
+}
+
+// run hands production from one node to the other. If the account isn't scheduled there are no slots to miss, and
+// it switches right away.
+func (h *handover) run(scheduled bool) error {
+	toPaused, err := h.to.producer.IsPaused()
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.to.name, err)
+	}
+	if !toPaused {
+		return fmt.Errorf("%s is already producing, nothing to hand over", h.to.name)
+	}
+	fromPaused, err := h.from.producer.IsPaused()
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.from.name, err)
+	}
+	info, err := h.to.api.GetInfo()
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.to.name, err)
+	}
+	if (blockNumProd{BlockHeadTime: info.HeadBlockTime.Time}).syncing() {
+		return fmt.Errorf("%s is not synced, head block time is %s", h.to.name, info.HeadBlockTime.String())
+	}
+
+	switch {
+	case fromPaused:
+		log.Printf("%s is not producing, resuming %s now", h.from.name, h.to.name)
+	case !scheduled:
+		log.Printf("%s is not in the active schedule, switching now", h.account)
+	default:
+		log.Printf("waiting for %s to finish its slot", h.account)
+		next, err := h.slotEnd()
+		if err != nil {
+			return err
+		}
+		log.Printf("slot finished, block %d was produced by %s", next.HeadBlockNum, next.HeadBlockProducer)
+	}
+
+	// pause first, and be sure it worked, two nodes signing is worse than missing a round
+	if !fromPaused {
+		if err = h.from.producer.Pause(); err != nil {
+			return fmt.Errorf("could not pause %s, not resuming %s: %w", h.from.name, h.to.name, err)
+		}
+		if p, err := h.from.producer.IsPaused(); err != nil || !p {
+			if err == nil {
+				err = errors.New("still producing")
+			}
+			return fmt.Errorf("could not confirm %s is paused, not resuming %s: %w", h.from.name, h.to.name, err)
+		}
+		log.Println("paused", h.from.name)
+	}
+
+	if err = h.to.producer.Resume(); err != nil {
+		return h.rollback(fromPaused, fmt.Errorf("could not resume %s: %w", h.to.name, err))
+	}
+	log.Println("resumed", h.to.name)
+	if !scheduled {
+		return nil
+	}
+	return h.verify(fromPaused)
+}
+
+// slotEnd waits until the account has produced, and another producer has signed the next block.
+func (h *handover) slotEnd() (*eos.InfoResp, error) {
+	var ours bool
+	deadline := time.Now().Add(h.timeout)
+	for time.Now().Before(deadline) {
+		info, err := h.to.api.GetInfo()
+		if err != nil {
+			log.Println(err)
+			time.Sleep(h.poll)
+			continue
+		}
+		switch {
+		case info.HeadBlockProducer == h.account:
+			ours = true
+		case ours:
+			return info, nil
+		}
+		time.Sleep(h.poll)
+	}
+	return nil, fmt.Errorf("%s did not produce within %v, nothing was changed", h.account, h.timeout)
+}
+
+// verify waits for the next slot to confirm the new node is producing, handing production back if it isn't.
+func (h *handover) verify(fromPaused bool) error {
+	deadline := time.Now().Add(h.timeout)
+	for time.Now().Before(deadline) {
+		info, err := h.to.api.GetInfo()
+		if err == nil && info.HeadBlockProducer == h.account {
+			log.Printf("%s produced block %d, handover complete", h.to.name, info.HeadBlockNum)
+			return nil
+		}
+		time.Sleep(h.poll)
+	}
+	err := fmt.Errorf("%s did not produce within %v", h.to.name, h.timeout)
+	if e := h.to.producer.Pause(); e != nil {
+		return fmt.Errorf("%v, and could not pause it: %v", err, e)
+	}
+	return h.rollback(fromPaused, err)
+}
+
+// rollback resumes the original node after a failed handover, unless it wasn't producing to begin with.
+func (h *handover) rollback(fromPaused bool, err error) error {
+	if fromPaused {
+		return err
+	}
+	if e := h.from.producer.Resume(); e != nil {
+		return fmt.Errorf("%v, and could not resume %s again: %v", err, h.from.name, e)
+	}
+	log.Println("resumed", h.from.name, "again")
+	return err
+}
+
+// runHandover connects to the primary's producer api and moves production to the standby, or back to the primary.
+// It returns the exit code.
+func runHandover(cfg *settings, primaryUrl string, back bool, timeout time.Duration) int {
+	primaryApi, _, err := fio.NewConnection(nil, primaryUrl)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	primary := &handoverNode{name: "primary " + primaryUrl, api: primaryApi, producer: &localSwitch{api: primaryApi}}
+	standby := &handoverNode{name: "standby", api: cfg.api, producer: cfg.producer}
+	h := &handover{account: cfg.account, from: primary, to: standby, poll: 100 * time.Millisecond, timeout: timeout}
+	if back {
+		h.from, h.to = standby, primary
+	}
+
+	scheduled, err := isTop21(&neighbor{}, cfg.api, cfg.account)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("handing production for %s from %s to %s", cfg.account, h.from.name, h.to.name)
+	if err = h.run(scheduled); err != nil {
+		log.Println("handover failed:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHead plays back a list of head block producers, one per GetInfo call, repeating the last one.
+type fakeHead struct {
+	mux   sync.Mutex
+	prods []string
+	calls int
+}
+
+func (f *fakeHead) GetInfo() (*eos.InfoResp, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	i := f.calls
+	if i >= len(f.prods) {
+		i = len(f.prods) - 1
+	}
+	f.calls += 1
+	return &eos.InfoResp{
+		HeadBlockNum:      uint32(100 + i),
+		HeadBlockProducer: eos.AccountName(f.prods[i]),
+		HeadBlockTime:     eos.JSONTime{Time: time.Now()},
+	}, nil
+}
+
+func (f *fakeHead) position() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.calls
+}
+
+// fakeSwitch records calls as '<name> <call>@<head position>'
+type fakeSwitch struct {
+	name      string
+	paused    bool
+	failPause bool
+	failRes   bool
+	head      *fakeHead
+	calls     *[]string
+}
+
+func (f *fakeSwitch) Name() string {
+	return f.name
+}
+
+func (f *fakeSwitch) record(call string) {
+	*f.calls = append(*f.calls, fmt.Sprintf("%s %s@%d", f.name, call, f.head.position()))
+}
+
+func (f *fakeSwitch) Pause() error {
+	f.record("pause")
+	if f.failPause {
+		return errors.New("pause failed")
+	}
+	f.paused = true
+	return nil
+}
+
+func (f *fakeSwitch) Resume() error {
+	f.record("resume")
+	if f.failRes {
+		return errors.New("resume failed")
+	}
+	f.paused = false
+	return nil
+}
+
+func (f *fakeSwitch) IsPaused() (bool, error) {
+	return f.paused, nil
+}
+
+func TestHandover(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	setup := func(prods ...string) (*handover, *fakeSwitch, *fakeSwitch, *[]string) {
+		calls := make([]string, 0)
+		head := &fakeHead{prods: prods}
+		primary := &fakeSwitch{name: "primary", head: head, calls: &calls}
+		standby := &fakeSwitch{name: "standby", paused: true, head: head, calls: &calls}
+		return &handover{
+			account: testBp,
+			from:    &handoverNode{name: "primary", api: head, producer: primary},
+			to:      &handoverNode{name: "standby", api: head, producer: standby},
+			poll:    time.Millisecond,
+			timeout: 100 * time.Millisecond,
+		}, primary, standby, &calls
+	}
+	expect := func(calls *[]string, want ...string) {
+		t.Helper()
+		if strings.Join(*calls, ",") != strings.Join(want, ",") {
+			t.Errorf("expected %v got %v", want, *calls)
+		}
+	}
+
+	// the first GetInfo is the sync check, switch right after the first block following our slot (position 5)
+	h, primary, standby, calls := setup("aproducer111", "aproducer111", testBp, testBp, "zproducer111", "zproducer111", testBp)
+	if err := h.run(true); err != nil {
+		t.Fatal(err)
+	}
+	expect(calls, "primary pause@5", "standby resume@5")
+	if !primary.paused || standby.paused {
+		t.Error("standby should be producing")
+	}
+
+	// handing back works the same way
+	h.from, h.to = h.to, h.from
+	h.from.api.(*fakeHead).prods = []string{testBp, testBp, "zproducer111", testBp}
+	h.from.api.(*fakeHead).calls = 0
+	*calls = (*calls)[:0]
+	if err := h.run(true); err != nil {
+		t.Fatal(err)
+	}
+	expect(calls, "standby pause@3", "primary resume@3")
+
+	// slot never arrives, nothing changes
+	h, _, _, calls = setup("aproducer111")
+	if err := h.run(true); err == nil {
+		t.Error("expected timeout")
+	}
+	expect(calls)
+
+	// not scheduled, no need to wait
+	h, _, _, calls = setup("aproducer111")
+	if err := h.run(false); err != nil {
+		t.Fatal(err)
+	}
+	expect(calls, "primary pause@1", "standby resume@1")
+
+	// pause fails, standby is not resumed
+	h, primary, _, calls = setup("aproducer111", testBp, "zproducer111")
+	primary.failPause = true
+	if err := h.run(true); err == nil {
+		t.Error("expected error when pause fails")
+	}
+	expect(calls, "primary pause@3")
+
+	// resume fails, primary goes back to producing
+	h, primary, standby, calls = setup("aproducer111", testBp, "zproducer111", testBp)
+	standby.failRes = true
+	if err := h.run(true); err == nil {
+		t.Error("expected error when resume fails")
+	}
+	expect(calls, "primary pause@3", "standby resume@3", "primary resume@3")
+	if primary.paused {
+		t.Error("primary should be producing again")
+	}
+
+	// standby resumed but doesn't produce, hand back after our slot is missed
+	h, primary, standby, calls = setup("aproducer111", testBp, "zproducer111")
+	if err := h.run(true); err == nil {
+		t.Error("expected error when standby doesn't produce")
+	}
+	if len(*calls) != 4 || !strings.HasPrefix((*calls)[2], "standby pause") || primary.paused || !standby.paused {
+		t.Error("should hand back when standby doesn't produce", *calls)
+	}
+
+	// standby already producing
+	h, _, standby, calls = setup(testBp)
+	standby.paused = false
+	if err := h.run(true); err == nil {
+		t.Error("expected error when both are producing")
+	}
+	expect(calls)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Before resuming, the standby checks that its own node is fit to produce. Taking over with a node that has lost
+// its peers, is on a fork, or is about to run out of space makes an outage worse: missed blocks turn into forks.
+
+// netPeer is the part of /v1/net/connections that's needed, the handshake has key and signature formats that don't
+// always parse.
+type netPeer struct {
+	Peer          string `json:"peer"`
+	Connecting    bool   `json:"connecting"`
+	Syncing       bool   `json:"syncing"`
+	LastHandshake struct {
+		HeadNum uint32 `json:"head_num"`
+	} `json:"last_handshake"`
+}
+
+// nodeHealth runs the checks. The peer and disk checks need the net_api_plugin and db_size_api_plugin, if they
+// aren't loaded the check is turned off when starting.
+type nodeHealth struct {
+	info        infoReader
+	connections func() ([]netPeer, error)
+	dbSize      func() (*eos.DBSizeResp, error)
+	refs        []infoReader // independent endpoints to compare the head with, the head check is skipped without any
+	limits      *tuning
+
+	peersOff bool
+	diskOff  bool
+
+	mux        sync.Mutex
+	lib        uint32
+	libChanged time.Time
+}
+
+func newNodeHealth(api *fio.API, refs []string, limits *tuning) *nodeHealth {
+	h := &nodeHealth{
+		info:   api,
+		dbSize: api.GetDBSize,
+		limits: limits,
+		connections: func() ([]netPeer, error) {
+			return netConnections(api)
+		},
+	}
+	for _, u := range refs {
+		h.refs = append(h.refs, &fio.API{API: eos.New(strings.TrimSpace(u))})
+	}
+	return h
+}
+
+// netConnections calls /v1/net/connections directly, see netPeer
+func netConnections(api *fio.API) ([]netPeer, error) {
+	resp, err := api.HttpClient.Post(api.BaseURL+"/v1/net/connections", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, eos.ErrNotFound
+	case resp.StatusCode > 299:
+		return nil, fmt.Errorf("net/connections: status code=%d", resp.StatusCode)
+	}
+	peers := make([]netPeer, 0)
+	return peers, json.Unmarshal(body, &peers)
+}
+
+// notLoaded is true if a call failed because the api plugin isn't enabled
+func notLoaded(err error) bool {
+	var apiErr eos.APIError
+	return err == eos.ErrNotFound || (errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound)
+}
+
+// probe turns off the checks for apis that aren't available
+func (h *nodeHealth) probe() {
+	if h == nil {
+		return
+	}
+	if _, err := h.connections(); notLoaded(err) {
+		log.Println("net_api_plugin is not enabled, not checking peers before resuming")
+		h.peersOff = true
+	}
+	if _, err := h.dbSize(); notLoaded(err) {
+		log.Println("db_size_api_plugin is not enabled, not checking free space before resuming")
+		h.diskOff = true
+	}
+	if len(h.refs) == 0 && h.limits.get().MaxHeadLag > 0 {
+		log.Println("no '-fork-endpoints' or '-witnesses' to compare with, not checking the head block before resuming")
+	}
+}
+
+// observe records the last irreversible block, it is called on every head update.
+func (h *nodeHealth) observe(lib uint32, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if lib > h.lib || h.libChanged.IsZero() {
+		h.lib, h.libChanged = lib, now
+	}
+}
+
+// check runs every check, returning all of the failures. A nil nodeHealth is always healthy.
+func (h *nodeHealth) check(now time.Time) error {
+	if h == nil {
+		return nil
+	}
+	limits := h.limits.get()
+	problems := make([]string, 0)
+
+	if limits.MinPeers > 0 && !h.peersOff {
+		peers, err := h.connections()
+		connected := 0
+		for _, p := range peers {
+			if !p.Connecting && p.LastHandshake.HeadNum > 0 {
+				connected += 1
+			}
+		}
+		switch {
+		case err != nil:
+			problems = append(problems, "could not get peers: "+err.Error())
+		case connected < limits.MinPeers:
+			problems = append(problems, fmt.Sprintf("%d connected peers, need %d", connected, limits.MinPeers))
+		}
+	}
+
+	if limits.MaxHeadLag > 0 && len(h.refs) > 0 {
+		if err := h.checkHead(limits.MaxHeadLag); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if limits.LibStall > 0 {
+		h.mux.Lock()
+		lib, changed := h.lib, h.libChanged
+		h.mux.Unlock()
+		if !changed.IsZero() && now.Sub(changed) > limits.LibStall {
+			problems = append(problems, fmt.Sprintf("irreversible block %d hasn't advanced for %v", lib, now.Sub(changed).Round(time.Second)))
+		}
+	}
+
+	if limits.MinFreeMB > 0 && !h.diskOff {
+		db, err := h.dbSize()
+		switch {
+		case err != nil:
+			problems = append(problems, "could not get db size: "+err.Error())
+		case int64(db.FreeBytes)/1024/1024 < limits.MinFreeMB:
+			problems = append(problems, fmt.Sprintf("%d MB free in the state db, need %d", int64(db.FreeBytes)/1024/1024, limits.MinFreeMB))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// checkHead compares our head with the highest head on the independent endpoints. Only one endpoint needs to answer.
+func (h *nodeHealth) checkHead(maxLag uint32) error {
+	local, err := h.info.GetInfo()
+	if err != nil {
+		return fmt.Errorf("could not get local head: %w", err)
+	}
+	var highest uint32
+	for _, ref := range h.refs {
+		if info, err := ref.GetInfo(); err == nil && info.HeadBlockNum > highest {
+			highest = info.HeadBlockNum
+		}
+	}
+	switch {
+	case highest == 0:
+		return errors.New("none of the endpoints answered to compare the head block")
+	case highest > local.HeadBlockNum && highest-local.HeadBlockNum > maxLag:
+		return fmt.Errorf("head block %d is %d blocks behind the endpoints", local.HeadBlockNum, highest-local.HeadBlockNum)
+	}
+	return nil
+}
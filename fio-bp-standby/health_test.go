@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// headAt is an infoReader with a fixed head block
+type headAt uint32
+
+func (h headAt) GetInfo() (*eos.InfoResp, error) {
+	if h == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &eos.InfoResp{HeadBlockNum: uint32(h)}, nil
+}
+
+func TestNodeHealth(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	connected := func(n int) []netPeer {
+		peers := make([]netPeer, n+1)
+		for i := 0; i < n; i++ {
+			peers[i].LastHandshake.HeadNum = 1000
+		}
+		peers[n].Connecting = true
+		return peers
+	}
+	var (
+		peers = connected(3)
+		free  = int64(1024 * 1024 * 1024)
+	)
+	h := &nodeHealth{
+		info:        headAt(1000),
+		refs:        []infoReader{headAt(0), headAt(1005)},
+		limits:      newTuning(defaultThresholds()),
+		connections: func() ([]netPeer, error) { return peers, nil },
+		dbSize: func() (*eos.DBSizeResp, error) {
+			return &eos.DBSizeResp{FreeBytes: eos.Int64(free)}, nil
+		},
+	}
+	now := time.Now()
+	h.observe(500, now)
+	if err := h.check(now.Add(time.Minute)); err != nil {
+		t.Fatal("should be healthy:", err)
+	}
+
+	peers, free = connected(1), 10*1024*1024
+	h.refs = []infoReader{headAt(1100)}
+	err := h.check(now.Add(3 * time.Minute))
+	if err == nil {
+		t.Fatal("expected every check to fail")
+	}
+	for _, want := range []string{"1 connected peers", "100 blocks behind", "hasn't advanced", "10 MB free"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected '%s' in: %v", want, err)
+		}
+	}
+
+	// irreversible block moving again
+	h.observe(501, now.Add(3*time.Minute))
+	if err = h.check(now.Add(3 * time.Minute)); strings.Contains(err.Error(), "hasn't advanced") {
+		t.Error("irreversible block advanced", err)
+	}
+
+	// 0 skips a check, and plugins that aren't loaded are skipped
+	th := defaultThresholds()
+	th.MaxHeadLag = 0
+	h.limits.set(th)
+	h.connections = func() ([]netPeer, error) { return nil, eos.ErrNotFound }
+	h.dbSize = func() (*eos.DBSizeResp, error) { return nil, eos.APIError{Code: 404} }
+	h.probe()
+	if err = h.check(now.Add(3 * time.Minute)); err != nil {
+		t.Error("skipped checks should not fail:", err)
+	}
+
+	// without reference endpoints the head check is skipped, and that is logged
+	th.MaxHeadLag = 12
+	h.limits.set(th)
+	h.refs = nil
+	logged := &strings.Builder{}
+	log.SetOutput(logged)
+	h.probe()
+	log.SetOutput(ioutil.Discard)
+	if !strings.Contains(logged.String(), "not checking the head block") {
+		t.Error("expected the skipped head check to be logged:", logged.String())
+	}
+	if err = h.check(now.Add(3 * time.Minute)); err != nil {
+		t.Error("the head check should be skipped without endpoints:", err)
+	}
+
+	var nilHealth *nodeHealth
+	if nilHealth.check(now) != nil {
+		t.Error("nil health should always pass")
+	}
+}
+
+func TestNetConnections(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	loaded := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loaded || r.URL.Path != "/v1/net/connections" {
+			http.NotFound(w, r)
+			return
+		}
+		// keys and signatures are left out of the fake handshake, they aren't decoded
+		_, _ = w.Write([]byte(`[
+			{"peer":"peer1:9876","connecting":false,"syncing":false,"last_handshake":{"head_num":1000,"key":"EOS1111111111111111111111111111111114T1Anm"}},
+			{"peer":"peer2:9876","connecting":true,"syncing":false,"last_handshake":{"head_num":0}}
+		]`))
+	}))
+	defer srv.Close()
+
+	api := &fio.API{API: eos.New(srv.URL)}
+	peers, err := netConnections(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].LastHandshake.HeadNum != 1000 || !peers[1].Connecting {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+	loaded = false
+	if _, err = netConnections(api); !notLoaded(err) {
+		t.Error("expected not loaded, got", err)
+	}
+}
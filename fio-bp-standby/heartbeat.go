@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On-chain data only shows the primary is gone after it has missed blocks, and can't tell a stopped primary from a
+// partitioned standby. An agent running next to the primary sends signed heartbeats to the standby with its paused
+// state and head block. A live heartbeat from a primary that is producing vetoes any takeover, and heartbeats
+// stopping while the head stalls on our turn is enough to resume without waiting for more missed blocks.
+
+func init() {
+	registerOptionalDetector("heartbeat", func() Detector { return &heartbeatDetector{interval: time.Second} })
+}
+
+type primaryHeartbeat struct {
+	Account   string    `json:"account"`
+	Paused    bool      `json:"paused"`
+	HeadBlock uint32    `json:"head_block"`
+	HeadTime  time.Time `json:"head_time"`
+	Sent      time.Time `json:"sent"`
+	Seq       uint64    `json:"seq"`
+}
+
+// producing is true if the primary's producer isn't paused and its node is synced
+func (b primaryHeartbeat) producing(now time.Time) bool {
+	return !b.Paused && !(blockNumProd{BlockHeadTime: b.HeadTime}).syncingAt(now)
+}
+
+const heartbeatSignature = "X-Heartbeat-Signature"
+
+func signHeartbeat(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// primaryWatch holds the last heartbeat from the primary, a nil primaryWatch never vetoes.
+type primaryWatch struct {
+	account eos.AccountName
+	secret  string
+	limits  *tuning
+
+	mux      sync.Mutex
+	last     primaryHeartbeat
+	received time.Time
+}
+
+func newPrimaryWatch(account eos.AccountName, secret string, limits *tuning) *primaryWatch {
+	return &primaryWatch{account: account, secret: secret, limits: limits}
+}
+
+// accept checks a heartbeat's signature and freshness before recording it
+func (p *primaryWatch) accept(body []byte, signature string, now time.Time) error {
+	if !hmac.Equal([]byte(signature), []byte(signHeartbeat(p.secret, body))) {
+		return errors.New("invalid signature")
+	}
+	beat := primaryHeartbeat{}
+	if err := json.Unmarshal(body, &beat); err != nil {
+		return err
+	}
+	if beat.Account != string(p.account) {
+		return fmt.Errorf("heartbeat is for %s, not %s", beat.Account, p.account)
+	}
+	if skew := now.Sub(beat.Sent); skew > 30*time.Second || skew < -30*time.Second {
+		return fmt.Errorf("heartbeat was sent at %s, check the clocks", beat.Sent.Format(time.RFC3339))
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !beat.Sent.After(p.last.Sent) {
+		return errors.New("heartbeat is older than the last one")
+	}
+	if p.received.IsZero() {
+		log.Printf("receiving heartbeats from the primary, paused: %v, head block %d", beat.Paused, beat.HeadBlock)
+	}
+	p.last, p.received = beat, now
+	return nil
+}
+
+// get returns the last heartbeat, seen is false if none has ever arrived and live is false if it's too old
+func (p *primaryWatch) get(now time.Time) (beat primaryHeartbeat, seen bool, live bool) {
+	if p == nil {
+		return
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	seen = !p.received.IsZero()
+	return p.last, seen, seen && now.Sub(p.received) <= p.limits.get().PrimaryTimeout
+}
+
+// veto returns an error if the primary says it is producing
+func (p *primaryWatch) veto(now time.Time) error {
+	if beat, _, live := p.get(now); live && beat.producing(now) {
+		return fmt.Errorf("primary reports it is producing, head block %d", beat.HeadBlock)
+	}
+	return nil
+}
+
+// heartbeatHandler receives heartbeats from the agent
+func heartbeatHandler(p *primaryWatch) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = p.accept(body, r.Header.Get(heartbeatSignature), time.Now()); err != nil {
+			log.Println("rejected heartbeat from", r.RemoteAddr+":", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// agentChain is the subset of *fio.API the agent uses
+type agentChain interface {
+	infoReader
+	IsProducerPaused() (bool, error)
+}
+
+// runAgent runs next to the primary, sending a heartbeat to each standby every interval. It never returns. If the
+// producer api can't be reached nothing is sent, the standby can't trust a heartbeat without the paused state.
+func runAgent(api agentChain, account eos.AccountName, standbys []string, secret string, interval time.Duration) {
+	client := &http.Client{Timeout: interval}
+	log.Printf("sending heartbeats for %s to %s", account, strings.Join(standbys, ", "))
+	failing := make(map[string]bool)
+	mux := sync.Mutex{}
+	for seq := uint64(1); ; seq++ {
+		time.Sleep(interval)
+		beat := primaryHeartbeat{Account: string(account), Seq: seq}
+		var err error
+		if beat.Paused, err = api.IsProducerPaused(); err != nil {
+			log.Println("producer api:", err)
+			continue
+		}
+		info, err := api.GetInfo()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		beat.HeadBlock, beat.HeadTime, beat.Sent = info.HeadBlockNum, info.HeadBlockTime.Time, time.Now().UTC()
+		body, _ := json.Marshal(beat)
+		sig := signHeartbeat(secret, body)
+		for _, s := range standbys {
+			go func(s string) {
+				err := sendHeartbeat(client, s, body, sig)
+				mux.Lock()
+				defer mux.Unlock()
+				// only log changes, this runs every second
+				switch {
+				case err != nil && !failing[s]:
+					log.Printf("could not send heartbeat to %s: %v", s, err)
+				case err == nil && failing[s]:
+					log.Println("sending heartbeats to", s)
+				}
+				failing[s] = err != nil
+			}(s)
+		}
+	}
+}
+
+func sendHeartbeat(client *http.Client, standby string, body []byte, sig string) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(standby, "/")+"/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(heartbeatSignature, sig)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// agentApi is a *fio.API for the agent, a separate func so opts doesn't need to know about the agent's interface
+func agentApi(url string) (agentChain, error) {
+	api, _, err := fio.NewConnection(nil, url)
+	return api, err
+}
+
+// heartbeatDetector uses the primary's heartbeats. While paused, heartbeats stopping (or the primary reporting it
+// is paused) while the head stalls on our turn for missed_increments polls is declared missing. While producing, a
+// heartbeat saying the primary is producing again means two nodes are signing, so it pauses.
+type heartbeatDetector struct {
+	interval time.Duration
+
+	lastBlock uint32
+	stalls    int // polls in a row the head hasn't moved
+	warned    bool
+}
+
+func (d *heartbeatDetector) Name() string {
+	return "primary heartbeat"
+}
+
+func (d *heartbeatDetector) Interval() time.Duration {
+	return d.interval
+}
+
+func (d *heartbeatDetector) Start(w *watch, events chan<- event, failed chan<- error) {
+	runSteps(d, w, events, failed)
+}
+
+func (d *heartbeatDetector) Step(w *watch, now time.Time) ([]event, error) {
+	evs := []event{{Kind: eventHeartbeat, Source: d.Name()}}
+	block := w.head.get()
+	if block.BlockNum == d.lastBlock {
+		d.stalls += 1
+	} else {
+		d.stalls = 0
+	}
+	d.lastBlock = block.BlockNum
+	beat, seen, live := w.primary.get(now)
+	if !seen || block.syncingAt(now) {
+		if !seen && !d.warned {
+			log.Println("no heartbeat from the primary yet, is the agent running?")
+			d.warned = true
+		}
+		return evs, nil
+	}
+
+	if !w.isPaused() {
+		if live && beat.producing(now) {
+			evs = append(evs, event{Kind: eventRestored, Source: d.Name(), Reason: "primary reports it is producing again"})
+		}
+		return evs, nil
+	}
+	if live && beat.producing(now) {
+		return evs, nil
+	}
+	before, _, scheduled := w.neighbors.at(block.ScheduleVersion)
+	ourTurn := block.Producer == before || block.Producer == string(w.account)
+	if limit := w.limits.get().MissedIncrements; scheduled && ourTurn && d.stalls >= limit {
+		d.stalls = 0
+		reason := "has missed blocks, no heartbeat from the primary."
+		if live {
+			reason = "has missed blocks, the primary reports it is paused."
+		}
+		log.Printf("head block %d stalled on our turn, %s", block.BlockNum, reason)
+		evs = append(evs, event{Kind: eventMissing, Source: d.Name(), Reason: reason})
+	}
+	return evs, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrimaryWatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	p := newPrimaryWatch(testBp, "secret", newTuning(defaultThresholds()))
+	srv := httptest.NewServer(heartbeatHandler(p))
+	defer srv.Close()
+	client := &http.Client{Timeout: time.Second}
+
+	now := time.Now()
+	send := func(secret string, beat primaryHeartbeat) error {
+		body, _ := json.Marshal(beat)
+		return sendHeartbeat(client, srv.URL+"/", body, signHeartbeat(secret, body))
+	}
+	beat := primaryHeartbeat{Account: testBp, HeadBlock: 1000, HeadTime: now, Sent: now, Seq: 1}
+
+	if _, seen, _ := p.get(now); seen || p.veto(now) != nil {
+		t.Fatal("no heartbeat yet, should not veto")
+	}
+	if err := send("wrong", beat); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Error("expected the wrong secret to be rejected, got", err)
+	}
+	if err := send("secret", beat); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.veto(time.Now()); err == nil {
+		t.Error("a producing primary should veto")
+	}
+
+	// replayed, other account, clock skew
+	if err := send("secret", beat); err == nil {
+		t.Error("a replayed heartbeat should be rejected")
+	}
+	other := beat
+	other.Account, other.Sent = "zproducer111", now.Add(time.Second)
+	if err := send("secret", other); err == nil {
+		t.Error("a heartbeat for another account should be rejected")
+	}
+	other.Account, other.Sent = testBp, now.Add(-time.Minute)
+	if err := send("secret", other); err == nil {
+		t.Error("a heartbeat from a minute ago should be rejected")
+	}
+
+	// paused or syncing primaries don't veto
+	paused := beat
+	paused.Paused, paused.Sent = true, now.Add(time.Second)
+	if err := send("secret", paused); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.veto(time.Now()); err != nil {
+		t.Error("a paused primary should not veto:", err)
+	}
+	syncing := beat
+	syncing.HeadTime, syncing.Sent = now.Add(-time.Hour), now.Add(2*time.Second)
+	if err := send("secret", syncing); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.veto(time.Now()); err != nil {
+		t.Error("a syncing primary should not veto:", err)
+	}
+
+	// lost
+	if _, seen, live := p.get(time.Now().Add(6 * time.Second)); !seen || live {
+		t.Error("heartbeat should be seen but not live after primary_timeout")
+	}
+	var none *primaryWatch
+	if none.veto(now) != nil {
+		t.Error("nil primaryWatch should never veto")
+	}
+}
+
+func TestHeartbeatDetector(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	w := testWatch(&fakeChain{})
+	w.primary = newPrimaryWatch(testBp, "secret", newTuning(defaultThresholds()))
+	d := &heartbeatDetector{interval: time.Second}
+	has := func(evs []event, kind eventKind) bool {
+		for _, ev := range evs {
+			if ev.Kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+	beat := func(paused bool, sent time.Time) {
+		b := primaryHeartbeat{Account: testBp, Paused: paused, HeadBlock: 1000, HeadTime: sent, Sent: sent}
+		body, _ := json.Marshal(b)
+		if err := w.primary.accept(body, signHeartbeat("secret", body), sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	w.head.set(blockNumProd{Producer: "aproducer111", BlockNum: 1000, BlockHeadTime: now})
+	evs, _ := d.Step(w, now)
+	evs2, _ := d.Step(w, now.Add(time.Second))
+	if has(evs, eventMissing) || has(evs2, eventMissing) {
+		t.Error("should not act without ever seeing a heartbeat")
+	}
+
+	// primary is producing, head stalled on our turn
+	beat(false, now.Add(time.Second))
+	if evs, _ = d.Step(w, now.Add(2*time.Second)); has(evs, eventMissing) {
+		t.Error("should not be missing while the primary is producing")
+	}
+
+	// heartbeat lost, the head has now stalled for missed_increments polls
+	if evs, _ = d.Step(w, now.Add(8*time.Second)); !has(evs, eventMissing) {
+		t.Error("heartbeat lost and head stalled on our turn should be missing")
+	}
+
+	// head moving to another producer
+	w.head.set(blockNumProd{Producer: "mproducer111", BlockNum: 1001, BlockHeadTime: now.Add(8 * time.Second)})
+	d.Step(w, now.Add(8*time.Second))
+	if evs, _ = d.Step(w, now.Add(9*time.Second)); has(evs, eventMissing) {
+		t.Error("should not be missing outside of our turn")
+	}
+
+	// producing, and the primary comes back
+	w.isPaused = func() bool { return false }
+	beat(true, now.Add(9*time.Second))
+	if evs, _ = d.Step(w, now.Add(9*time.Second)); has(evs, eventRestored) {
+		t.Error("a paused primary should not pause the standby")
+	}
+	beat(false, now.Add(10*time.Second))
+	if evs, _ = d.Step(w, now.Add(10*time.Second)); !has(evs, eventRestored) {
+		t.Error("a producing primary should pause the standby")
+	}
+}
+
+func TestHeartbeatDetectorStall(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	w := testWatch(&fakeChain{})
+	w.limits = newTuning(defaultThresholds())
+	w.primary = newPrimaryWatch(testBp, "secret", w.limits)
+	d := &heartbeatDetector{interval: time.Second}
+	missing := func(evs []event) bool {
+		for _, ev := range evs {
+			if ev.Kind == eventMissing {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the primary was last heard from a minute ago, the head is on our turn
+	now := time.Now()
+	b := primaryHeartbeat{Account: testBp, HeadBlock: 1000, HeadTime: now.Add(-time.Minute), Sent: now.Add(-time.Minute)}
+	body, _ := json.Marshal(b)
+	if err := w.primary.accept(body, signHeartbeat("secret", body), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	step := func(block uint32, at time.Time) []event {
+		w.head.set(blockNumProd{Producer: testBp, BlockNum: block, BlockHeadTime: at})
+		evs, _ := d.Step(w, at)
+		return evs
+	}
+	step(1000, now)
+
+	// head pauses for one poll, then moves on
+	for i, block := range []uint32{1001, 1001, 1002, 1003} {
+		if evs := step(block, now.Add(time.Duration(i+1)*time.Second)); missing(evs) {
+			t.Fatalf("head paused for one poll at block %d, should not be missing", block)
+		}
+	}
+
+	// stalls for missed_increments polls
+	limit := w.limits.get().MissedIncrements
+	for i := 1; i <= limit; i++ {
+		evs := step(1003, now.Add(time.Duration(4+i)*time.Second))
+		if i < limit && missing(evs) {
+			t.Fatalf("missing after %d stalled polls, expected %d", i, limit)
+		}
+		if i == limit && !missing(evs) {
+			t.Errorf("head stalled %d polls on our turn, should be missing", limit)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When multiple standby nodes are running, only one of them can be allowed to resume production. Standbys share a
+// lease, only the holder may resume, and every time the lease changes hands the fencing token is incremented. The
+// token is checked against the backend immediately before resuming, so a standby that stalled after acquiring
+// the lease (GC pause, slow API call, etc.) can't resume after another node has taken over.
+
+var errLeaseHeld = errors.New("lease is held by another standby")
+
+type lease struct {
+	Holder  string    `json:"holder"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *lease) expired(now time.Time) bool {
+	return l.Holder == "" || now.After(l.Expires)
+}
+
+// grant is the common logic for all backends. The token only increments when the lease changes hands, renewals by
+// the current holder keep the same token.
+func (l *lease) grant(holder string, ttl time.Duration, now time.Time) error {
+	switch {
+	case l.Holder == holder && !l.expired(now):
+	case l.expired(now):
+		l.Holder = holder
+		l.Token += 1
+	default:
+		return errLeaseHeld
+	}
+	l.Expires = now.Add(ttl)
+	return nil
+}
+
+func (l *lease) release(holder string, token uint64) {
+	if l.Holder == holder && l.Token == token {
+		l.Holder = ""
+		l.Expires = time.Time{}
+	}
+}
+
+// leaseBackend stores the lease shared between standby nodes.
+type leaseBackend interface {
+	Acquire(holder string, ttl time.Duration) (*lease, error)
+	Release(holder string, token uint64) error
+	Current() (*lease, error)
+}
+
+// newLeaseBackend parses the -lease option, either a file:// path (should be on shared storage) or the http(s)://
+// url of a lease server.
+func newLeaseBackend(u string, secret string) (leaseBackend, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "file":
+		return &fileLease{path: parsed.Path}, nil
+	case "http", "https":
+		return &httpLease{url: strings.TrimRight(u, "/"), secret: secret, client: &http.Client{Timeout: 3 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unsupported lease backend '%s', use file:// or http(s)://", u)
+}
+
+// memLease is held in memory, it's the store for the lease server.
+type memLease struct {
+	mux sync.Mutex
+	cur lease
+}
+
+func (m *memLease) Acquire(holder string, ttl time.Duration) (*lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	err := m.cur.grant(holder, ttl, time.Now())
+	l := m.cur
+	return &l, err
+}
+
+func (m *memLease) Release(holder string, token uint64) error {
+	m.mux.Lock()
+	m.cur.release(holder, token)
+	m.mux.Unlock()
+	return nil
+}
+
+func (m *memLease) Current() (*lease, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	l := m.cur
+	return &l, nil
+}
+
+// fileLease stores the lease in a json file, updates are guarded by a lock file.
+type fileLease struct {
+	path string
+}
+
+func (f *fileLease) lock() (unlock func(), err error) {
+	lockFile := f.path + ".lock"
+	for i := 0; i < 50; i++ {
+		var lf *os.File
+		lf, err = os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_ = lf.Close()
+			return func() { _ = os.Remove(lockFile) }, nil
+		}
+		// a lock that's more than a few seconds old was left behind by a crashed process
+		if st, e := os.Stat(lockFile); e == nil && st.ModTime().Before(time.Now().Add(-5*time.Second)) {
+			_ = os.Remove(lockFile)
+			continue
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, errors.New("could not lock " + lockFile + ": " + err.Error())
+}
+
+func (f *fileLease) read() (*lease, error) {
+	l := &lease{}
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return l, nil
+	}
+	return l, json.Unmarshal(b, l)
+}
+
+func (f *fileLease) write(l *lease) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".lease")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	_ = tmp.Close()
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileLease) Acquire(holder string, ttl time.Duration) (*lease, error) {
+	unlock, err := f.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	l, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	if err = l.grant(holder, ttl, time.Now()); err != nil {
+		return l, err
+	}
+	return l, f.write(l)
+}
+
+func (f *fileLease) Release(holder string, token uint64) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	l, err := f.read()
+	if err != nil {
+		return err
+	}
+	l.release(holder, token)
+	return f.write(l)
+}
+
+func (f *fileLease) Current() (*lease, error) {
+	return f.read()
+}
+
+// httpLease is a client for the lease server
+type httpLease struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+type leaseRequest struct {
+	Holder string `json:"holder"`
+	Token  uint64 `json:"token,omitempty"`
+	TtlMs  int64  `json:"ttl_ms,omitempty"`
+}
+
+func (h *httpLease) post(endpoint string, req *leaseRequest) (*lease, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, h.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if h.secret != "" {
+		r.Header.Set("Authorization", "Bearer "+h.secret)
+	}
+	resp, err := h.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return l, json.Unmarshal(b, l)
+	case http.StatusConflict:
+		_ = json.Unmarshal(b, l)
+		return l, errLeaseHeld
+	}
+	return nil, fmt.Errorf("lease server returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+func (h *httpLease) Acquire(holder string, ttl time.Duration) (*lease, error) {
+	return h.post("/lease/acquire", &leaseRequest{Holder: holder, TtlMs: ttl.Milliseconds()})
+}
+
+func (h *httpLease) Release(holder string, token uint64) error {
+	_, err := h.post("/lease/release", &leaseRequest{Holder: holder, Token: token})
+	return err
+}
+
+func (h *httpLease) Current() (*lease, error) {
+	return h.post("/lease/current", &leaseRequest{})
+}
+
+// leaseHandler serves a backend to other standby nodes, every request needs the shared secret.
+func leaseHandler(backend leaseBackend, secret string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(f func(req *leaseRequest) (*lease, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+secret)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			req := &leaseRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l, err := f(req)
+			w.Header().Set("Content-Type", "application/json")
+			switch err {
+			case nil:
+			case errLeaseHeld:
+				w.WriteHeader(http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(l)
+		}
+	}
+	mux.HandleFunc("/lease/acquire", handle(func(req *leaseRequest) (*lease, error) {
+		if req.Holder == "" || req.TtlMs <= 0 {
+			return nil, errors.New("holder and ttl_ms are required")
+		}
+		return backend.Acquire(req.Holder, time.Duration(req.TtlMs)*time.Millisecond)
+	}))
+	mux.HandleFunc("/lease/release", handle(func(req *leaseRequest) (*lease, error) {
+		if err := backend.Release(req.Holder, req.Token); err != nil {
+			return nil, err
+		}
+		return backend.Current()
+	}))
+	mux.HandleFunc("/lease/current", handle(func(req *leaseRequest) (*lease, error) {
+		return backend.Current()
+	}))
+	return mux
+}
+
+// coordinator decides if this standby is allowed to produce. A nil coordinator always allows it, which is the
+// behavior when only one standby is running.
+type coordinator struct {
+	backend leaseBackend
+	id      string
+	ttl     time.Duration
+
+	mux      sync.Mutex
+	held     *lease
+	acquired time.Time
+	highest  uint64 // highest fencing token seen, tokens must never go backwards
+}
+
+func newCoordinator(backend leaseBackend, id string, ttl time.Duration) *coordinator {
+	return &coordinator{backend: backend, id: id, ttl: ttl}
+}
+
+func (c *coordinator) observe(l *lease) error {
+	if l == nil {
+		return nil
+	}
+	if l.Token < c.highest {
+		return fmt.Errorf("lease token went backwards from %d to %d, refusing to trust lease backend", c.highest, l.Token)
+	}
+	c.highest = l.Token
+	return nil
+}
+
+// acquire gets (or renews) the lease, returning the fencing token.
+func (c *coordinator) acquire() (uint64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	l, err := c.backend.Acquire(c.id, c.ttl)
+	if e := c.observe(l); e != nil {
+		return 0, e
+	}
+	if err != nil {
+		if err == errLeaseHeld && l != nil {
+			return 0, fmt.Errorf("%w: %s (token %d) until %s", err, l.Holder, l.Token, l.Expires.UTC().Format(time.RFC3339))
+		}
+		return 0, err
+	}
+	if c.held == nil || c.held.Token != l.Token {
+		c.acquired = time.Now()
+	}
+	c.held = l
+	return l.Token, nil
+}
+
+// fence is called immediately before resuming production, it confirms the token is still the current lease.
+func (c *coordinator) fence(token uint64) error {
+	if c == nil {
+		return nil
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	l, err := c.backend.Current()
+	if err != nil {
+		return err
+	}
+	if err = c.observe(l); err != nil {
+		return err
+	}
+	switch {
+	case l.Holder != c.id:
+		return fmt.Errorf("fencing token %d is stale, lease is held by '%s'", token, l.Holder)
+	case l.Token != token:
+		return fmt.Errorf("fencing token %d is stale, current token is %d", token, l.Token)
+	case l.expired(time.Now()):
+		return fmt.Errorf("lease for fencing token %d has expired", token)
+	}
+	return nil
+}
+
+// release gives up the lease after pausing
+func (c *coordinator) release() {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.held == nil {
+		return
+	}
+	if err := c.backend.Release(c.id, c.held.Token); err != nil {
+		log.Println("could not release lease:", err)
+	}
+	c.held = nil
+}
+
+// keepAlive renews the lease while producing, if the lease is lost production must stop.
+func (c *coordinator) keepAlive(w *watch, events chan<- event) {
+	if c == nil {
+		return
+	}
+	const name = "lease"
+	t := time.NewTicker(c.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+		if !w.send(events, event{Kind: eventHeartbeat, Source: name}) {
+			return
+		}
+		c.mux.Lock()
+		held, acquired := c.held, c.acquired
+		c.mux.Unlock()
+		if held == nil {
+			continue
+		}
+		// paused for some other reason (or resume failed), let another standby have it.
+		if w.isPaused() && time.Since(acquired) > c.ttl/3 {
+			c.release()
+			continue
+		}
+		token, err := c.acquire()
+		switch {
+		case err == nil && token == held.Token:
+			continue
+		case err == nil:
+			err = fmt.Errorf("fencing token changed from %d to %d", held.Token, token)
+		case errors.Is(err, errLeaseHeld):
+		case time.Now().Before(held.Expires):
+			// can't reach the backend, but still have time before the lease expires.
+			log.Println("could not renew lease:", err)
+			continue
+		}
+		log.Println("lost lease:", err)
+		c.mux.Lock()
+		c.held = nil
+		c.mux.Unlock()
+		if !w.send(events, event{Kind: eventRestored, Source: name, Reason: "lost lease: " + err.Error()}) {
+			return
+		}
+	}
+}
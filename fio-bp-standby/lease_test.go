@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaseGrant(t *testing.T) {
+	now := time.Now()
+	l := &lease{}
+	if err := l.grant("a", time.Minute, now); err != nil || l.Token != 1 {
+		t.Fatal("first grant should succeed with token 1", err, l.Token)
+	}
+	if err := l.grant("a", time.Minute, now.Add(time.Second)); err != nil || l.Token != 1 {
+		t.Error("renewal should keep the same token", err, l.Token)
+	}
+	if err := l.grant("b", time.Minute, now.Add(2*time.Second)); err != errLeaseHeld {
+		t.Error("expected lease to be held", err)
+	}
+	if err := l.grant("b", time.Minute, now.Add(2*time.Minute)); err != nil || l.Token != 2 {
+		t.Error("expired lease should be granted with a new token", err, l.Token)
+	}
+	l.release("a", 1)
+	if l.Holder != "b" {
+		t.Error("stale holder should not be able to release the lease")
+	}
+	l.release("b", 2)
+	if !l.expired(now) {
+		t.Error("lease should be released")
+	}
+}
+
+func testCoordinators(t *testing.T, backend leaseBackend) {
+	a := newCoordinator(backend, "standby-a", 200*time.Millisecond)
+	b := newCoordinator(backend, "standby-b", 200*time.Millisecond)
+
+	tokenA, err := a.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.acquire(); !errors.Is(err, errLeaseHeld) {
+		t.Fatal("second standby should not get the lease", err)
+	}
+	if err = a.fence(tokenA); err != nil {
+		t.Error("fence should pass for the holder", err)
+	}
+
+	// a stalls, b takes over after expiry and a's token must now be rejected
+	time.Sleep(250 * time.Millisecond)
+	tokenB, err := b.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenB <= tokenA {
+		t.Errorf("fencing token should increase, %d -> %d", tokenA, tokenB)
+	}
+	if err = a.fence(tokenA); err == nil {
+		t.Error("stale token should be fenced")
+	}
+	if err = b.fence(tokenB); err != nil {
+		t.Error(err)
+	}
+
+	b.release()
+	if _, err = a.acquire(); err != nil {
+		t.Error("lease should be available after release", err)
+	}
+}
+
+func TestCoordinatorMem(t *testing.T) {
+	testCoordinators(t, &memLease{})
+}
+
+func TestCoordinatorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testCoordinators(t, &fileLease{path: filepath.Join(dir, "lease.json")})
+}
+
+func TestCoordinatorHttp(t *testing.T) {
+	server := httptest.NewServer(leaseHandler(&memLease{}, "secret"))
+	defer server.Close()
+
+	backend, err := newLeaseBackend(server.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCoordinators(t, backend)
+
+	bad, _ := newLeaseBackend(server.URL, "wrong")
+	if _, err = bad.Current(); err == nil {
+		t.Error("expected unauthorized")
+	}
+
+	// a handler without a secret refuses everything
+	open := httptest.NewServer(leaseHandler(&memLease{}, ""))
+	defer open.Close()
+	anon, _ := newLeaseBackend(open.URL, "")
+	if _, err = anon.Current(); err == nil {
+		t.Error("expected a lease server without a secret to refuse requests")
+	}
+}
+
+func TestKeepAliveLostLease(t *testing.T) {
+	backend := &memLease{}
+	c := newCoordinator(backend, "standby-a", 90*time.Millisecond)
+	if _, err := c.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	// simulate another standby taking over
+	backend.mux.Lock()
+	backend.cur = lease{Holder: "standby-b", Token: 5, Expires: time.Now().Add(time.Minute)}
+	backend.mux.Unlock()
+
+	events := make(chan event)
+	go c.keepAlive(&watch{isPaused: func() bool { return false }}, events)
+	if _, ok := waitFor(t, events, nil, eventRestored, time.Second); !ok {
+		t.Fatal("losing the lease should stop production")
+	}
+}
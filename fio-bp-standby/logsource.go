@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The nodeos log can come from a few places depending on how nodeos is run: a file written by systemd or a wrapper
+// script, the journal, docker, or piped in on stdin. Each LogSource follows one of these, reconnecting on its own
+// if the source goes away.
+
+type logLine struct {
+	Time time.Time
+	Text string
+}
+
+// LogSource streams new lines from a nodeos log. Follow blocks, sending lines as they arrive. Sources that can
+// reconnect report each failure on failed and keep going, Follow only returns if the source can never recover.
+type LogSource interface {
+	Name() string
+	Follow(lines chan<- logLine, failed chan<- error)
+}
+
+// newLogSource creates a LogSource from a spec. 'file:/var/log/fio/nodeos.log' (or just a path) follows a file
+// across rotations, 'stdin' reads lines piped to this process, 'journalctl:<unit>' follows the journal for a systemd
+// unit, and 'docker:<container>' follows the output of a container.
+func newLogSource(spec string) (LogSource, error) {
+	kind, target := "file", spec
+	if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 {
+		kind, target = parts[0], parts[1]
+	}
+	if spec == "stdin" {
+		kind = "stdin"
+	}
+	switch kind {
+	case "file":
+		if target == "" {
+			return nil, errors.New("file log source needs a path")
+		}
+		return &fileSource{path: target, poll: 250 * time.Millisecond}, nil
+	case "stdin":
+		return &readerSource{name: "stdin", r: os.Stdin}, nil
+	case "journalctl":
+		if target == "" {
+			return nil, errors.New("journalctl log source needs a unit name")
+		}
+		return &commandSource{name: "journalctl " + target, args: []string{"journalctl", "-f", "-n", "0", "-o", "cat", "-u", target}}, nil
+	case "docker":
+		if target == "" {
+			return nil, errors.New("docker log source needs a container name")
+		}
+		return &commandSource{name: "docker " + target, args: []string{"docker", "logs", "-f", "--since", "0s", target}}, nil
+	}
+	return nil, fmt.Errorf("unknown log source '%s', one of: file, stdin, journalctl, docker", kind)
+}
+
+// fileSource follows a file from the end, similar to 'tail -F'. If the file is rotated by renaming, the rest of the
+// old file is read before opening the new one. If it is truncated (logrotate's copytruncate) any lines written
+// after the last read are recovered from the newest rotated copy, including gzip compressed copies.
+type fileSource struct {
+	path string
+	poll time.Duration
+}
+
+func (f *fileSource) Name() string {
+	return "file " + f.path
+}
+
+func (f *fileSource) Follow(lines chan<- logLine, failed chan<- error) {
+	var (
+		fh      *os.File
+		rd      *bufio.Reader
+		offset  int64
+		partial string
+		first   = true
+	)
+	open := func() error {
+		var err error
+		fh, err = os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		offset = 0
+		if first {
+			// only new lines, start from the end
+			if offset, err = fh.Seek(0, io.SeekEnd); err != nil {
+				_ = fh.Close()
+				fh = nil
+				return err
+			}
+			first = false
+		}
+		rd, partial = bufio.NewReader(fh), ""
+		return nil
+	}
+	// drain reads everything available, returning on EOF
+	drain := func() {
+		for {
+			s, err := rd.ReadString('\n')
+			offset += int64(len(s))
+			if err != nil {
+				partial += s
+				return
+			}
+			lines <- logLine{Time: time.Now(), Text: strings.TrimRight(partial+s, "\r\n")}
+			partial = ""
+		}
+	}
+
+	for {
+		if fh == nil {
+			if err := open(); err != nil {
+				failed <- fmt.Errorf("%s: %w", f.Name(), err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+		}
+		drain()
+		time.Sleep(f.poll)
+
+		cur, err := fh.Stat()
+		if err != nil {
+			failed <- fmt.Errorf("%s: %w", f.Name(), err)
+			_ = fh.Close()
+			fh = nil
+			continue
+		}
+		st, err := os.Stat(f.path)
+		switch {
+		case err != nil:
+			// removed, keep reading the old file until a new one shows up
+		case !os.SameFile(cur, st):
+			drain()
+			log.Printf("%s was rotated, reopening", f.path)
+			_ = fh.Close()
+			fh = nil
+		case st.Size() < offset:
+			log.Printf("%s was truncated, reading from the start", f.path)
+			f.catchUp(offset, lines)
+			if _, err = fh.Seek(0, io.SeekStart); err != nil {
+				_ = fh.Close()
+				fh = nil
+				continue
+			}
+			rd, offset, partial = bufio.NewReader(fh), 0, ""
+		}
+	}
+}
+
+// catchUp sends lines after offset from the most recently rotated copy of the file
+func (f *fileSource) catchUp(offset int64, lines chan<- logLine) {
+	rotated := rotatedCopy(f.path)
+	if rotated == "" {
+		return
+	}
+	fh, err := os.Open(rotated)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	var r io.Reader = fh
+	if strings.HasSuffix(rotated, ".gz") {
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, offset); err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines <- logLine{Time: time.Now(), Text: scanner.Text()}
+	}
+}
+
+// rotatedCopy finds the newest rotated file, ex: nodeos.log.1, nodeos.log.1.gz or nodeos.log-20210601.gz
+func rotatedCopy(path string) string {
+	candidates := make([]string, 0)
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		m, _ := filepath.Glob(pattern)
+		candidates = append(candidates, m...)
+	}
+	type mod struct {
+		name string
+		t    time.Time
+	}
+	mods := make([]mod, 0)
+	for _, c := range candidates {
+		if st, err := os.Stat(c); err == nil && !st.IsDir() {
+			mods = append(mods, mod{c, st.ModTime()})
+		}
+	}
+	if len(mods) == 0 {
+		return ""
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].t.After(mods[j].t)
+	})
+	return mods[0].name
+}
+
+// readerSource reads lines from a stream that can't be reopened, like stdin.
+type readerSource struct {
+	name string
+	r    io.Reader
+}
+
+func (rs *readerSource) Name() string {
+	return rs.name
+}
+
+func (rs *readerSource) Follow(lines chan<- logLine, failed chan<- error) {
+	scanner := bufio.NewScanner(rs.r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines <- logLine{Time: time.Now(), Text: scanner.Text()}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	failed <- fmt.Errorf("%s closed, no longer watching the log: %w", rs.name, err)
+}
+
+// commandSource runs a command that follows the log, restarting it with a backoff if it exits.
+type commandSource struct {
+	name string
+	args []string
+}
+
+func (c *commandSource) Name() string {
+	return c.name
+}
+
+func (c *commandSource) Follow(lines chan<- logLine, failed chan<- error) {
+	wait := time.Second
+	for {
+		started := time.Now()
+		err := c.run(lines)
+		if err == nil {
+			err = errors.New("exited")
+		}
+		// only back off if it keeps failing right away
+		if time.Since(started) > time.Minute {
+			wait = time.Second
+		}
+		failed <- fmt.Errorf("%s: %v, restarting in %v", c.name, err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+	}
+}
+
+func (c *commandSource) run(lines chan<- logLine) error {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	pr, pw := io.Pipe()
+	// nodeos logs to stderr, docker and journalctl keep the streams separate
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_ = pw.CloseWithError(cmd.Wait())
+	}()
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines <- logLine{Time: time.Now(), Text: scanner.Text()}
+	}
+	return scanner.Err()
+}
+
+// logHub runs a single LogSource and copies each line to every subscriber, so the duplicate detector and the
+// recorder can share a source that can only be read once. It starts on the first subscription.
+type logHub struct {
+	source LogSource
+	once   sync.Once
+	mux    sync.Mutex
+	subs   []chan logLine
+}
+
+func newLogHub(source LogSource) *logHub {
+	return &logHub{source: source}
+}
+
+func (h *logHub) subscribe(failed chan<- error, stop <-chan struct{}) <-chan logLine {
+	c := make(chan logLine, 1024)
+	h.mux.Lock()
+	h.subs = append(h.subs, c)
+	h.mux.Unlock()
+	h.once.Do(func() {
+		go h.run(failed, stop)
+	})
+	return c
+}
+
+// run copies lines until stop is closed. The source can't always be interrupted (stdin for one), it is left blocked
+// on its next line.
+func (h *logHub) run(failed chan<- error, stop <-chan struct{}) {
+	log.Println("following nodeos log from", h.source.Name())
+	lines := make(chan logLine)
+	errs := make(chan error)
+	go func() {
+		h.source.Follow(lines, errs)
+		close(lines)
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			stats.logLine(h.source.Name())
+			h.mux.Lock()
+			for _, c := range h.subs {
+				select {
+				case c <- line:
+				case <-stop:
+				}
+			}
+			h.mux.Unlock()
+		case err := <-errs:
+			stats.logError(h.source.Name())
+			select {
+			case failed <- err:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logMatcher finds duplicate block errors in the log, and which account signed the block. The account is the
+// named group 'account' if there is one, otherwise the first group.
+type logMatcher struct {
+	re    *regexp.Regexp
+	group int
+}
+
+var defaultLogMatch = `Block not applied to head.*signed by (\w{12})`
+
+func newLogMatcher(expr string) (*logMatcher, error) {
+	if expr == "" {
+		expr = defaultLogMatch
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() == 0 {
+		return nil, errors.New("log match needs a group for the account, ex: 'signed by (\\w{12})'")
+	}
+	m := &logMatcher{re: re, group: 1}
+	for i, name := range re.SubexpNames() {
+		if name == "account" {
+			m.group = i
+		}
+	}
+	return m, nil
+}
+
+// account returns the account that signed a duplicate block, or empty if the line doesn't match
+func (m *logMatcher) account(text string) string {
+	if match := m.re.FindStringSubmatch(text); len(match) > m.group {
+		return match[m.group]
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextLine waits for a line, failing the test on timeout
+func nextLine(t *testing.T, lines chan logLine) string {
+	t.Helper()
+	select {
+	case l := <-lines:
+		return l.Text
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a line")
+	}
+	return ""
+}
+
+func appendFile(t *testing.T, file, text string) {
+	t.Helper()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "nodeos.log")
+	appendFile(t, file, "old line, should be skipped\n")
+
+	lines, failed := make(chan logLine), make(chan error, 10)
+	go (&fileSource{path: file, poll: 10 * time.Millisecond}).Follow(lines, failed)
+	time.Sleep(50 * time.Millisecond)
+
+	appendFile(t, file, "one\ntw")
+	if l := nextLine(t, lines); l != "one" {
+		t.Fatal("expected 'one' got", l)
+	}
+	// partial line is held until it is complete
+	appendFile(t, file, "o\n")
+	if l := nextLine(t, lines); l != "two" {
+		t.Fatal("expected 'two' got", l)
+	}
+
+	// rotate by renaming, the last line written to the old file is still read
+	appendFile(t, file, "three\n")
+	if err = os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, file+".1", "four\n")
+	appendFile(t, file, "five\n")
+	for _, want := range []string{"three", "four", "five"} {
+		if l := nextLine(t, lines); l != want {
+			t.Fatalf("expected '%s' got '%s'", want, l)
+		}
+	}
+
+	// copytruncate with compression: lines written before the truncate are only in the gzip copy
+	gzFile, err := os.Create(file + ".2.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(gzFile)
+	_, _ = gz.Write([]byte("five\nsix\nseven\n"))
+	_ = gz.Close()
+	_ = gzFile.Close()
+	if err = os.Truncate(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	if l := nextLine(t, lines); l != "six" {
+		t.Fatal("expected 'six' from the rotated copy, got", l)
+	}
+	if l := nextLine(t, lines); l != "seven" {
+		t.Fatal("expected 'seven' from the rotated copy, got", l)
+	}
+	appendFile(t, file, "eight\n")
+	if l := nextLine(t, lines); l != "eight" {
+		t.Fatal("expected 'eight' after truncating, got", l)
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	lines, failed := make(chan logLine, 10), make(chan error, 1)
+	(&readerSource{name: "stdin", r: strings.NewReader("a\nb\n")}).Follow(lines, failed)
+	if len(lines) != 2 || nextLine(t, lines) != "a" {
+		t.Error("expected two lines")
+	}
+	select {
+	case err := <-failed:
+		if !strings.Contains(err.Error(), "stdin closed") {
+			t.Error(err)
+		}
+	default:
+		t.Error("closing stdin should report a failure")
+	}
+}
+
+func TestCommandSource(t *testing.T) {
+	lines, failed := make(chan logLine), make(chan error)
+	src := &commandSource{name: "test", args: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}}
+	go src.Follow(lines, failed)
+
+	got := map[string]bool{}
+	got[nextLine(t, lines)] = true
+	got[nextLine(t, lines)] = true
+	if !got["out"] || !got["err"] {
+		t.Error("should read stdout and stderr", got)
+	}
+	select {
+	case err := <-failed:
+		if !strings.Contains(err.Error(), "exit status 3") {
+			t.Error("unexpected error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("exit was not reported")
+	}
+	// restarted after the backoff
+	if l := nextLine(t, lines); l != "out" && l != "err" {
+		t.Error("command was not restarted", l)
+	}
+}
+
+func TestNewLogSource(t *testing.T) {
+	for spec, name := range map[string]string{
+		"/var/log/fio/nodeos.log":      "file /var/log/fio/nodeos.log",
+		"file:/var/log/fio/nodeos.log": "file /var/log/fio/nodeos.log",
+		"stdin":                        "stdin",
+		"journalctl:fio-nodeos":        "journalctl fio-nodeos",
+		"docker:nodeos":                "docker nodeos",
+	} {
+		src, err := newLogSource(spec)
+		if err != nil {
+			t.Error(spec, err)
+			continue
+		}
+		if src.Name() != name {
+			t.Errorf("%s: expected %s got %s", spec, name, src.Name())
+		}
+	}
+	for _, bad := range []string{"docker:", "journalctl:", "syslog:local0"} {
+		if _, err := newLogSource(bad); err == nil {
+			t.Error("expected error for", bad)
+		}
+	}
+}
+
+func TestLogMatcher(t *testing.T) {
+	m, err := newLogMatcher("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := m.account("Block not applied to head 1 signed by producer1111 id: 00"); a != testBp {
+		t.Error("default should match nodeos 2.0 message, got", a)
+	}
+	m, err = newLogMatcher(`(dup|duplicate) block from (?P<account>[a-z1-5.]{12})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := m.account("warn: duplicate block from producer1111"); a != testBp {
+		t.Error("should use the named group, got", a)
+	}
+	if a := m.account("nothing here"); a != "" {
+		t.Error("should not match", a)
+	}
+	if _, err = newLogMatcher("signed by"); err == nil {
+		t.Error("expected error without a group")
+	}
+	if _, err = newLogMatcher("("); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
@@ -3,27 +3,48 @@ package main
 import (
 	"errors"
 	"flag"
-	"github.com/PagerDuty/go-pagerduty"
+	"fmt"
 	"github.com/fioprotocol/fio-go"
 	"github.com/fioprotocol/fio-go/eos"
-	"github.com/hpcloud/tail"
 	"log"
+	"net/http"
 	"os"
-	"regexp"
-	"sort"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var (
-	active bool // tracks if currently top 21
-	paused bool // is this instance producing blocks?
-)
+// pausedState is whether this instance is producing blocks. Only the main loop changes it, the detectors read it
+// from their own routines.
+type pausedState struct {
+	v int32
+}
+
+func (p *pausedState) get() bool {
+	return atomic.LoadInt32(&p.v) == 1
+}
+
+func (p *pausedState) set(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	atomic.StoreInt32(&p.v, v)
+}
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.LUTC)
+	run(opts(), nil)
+}
+
+// run watches the producer and switches production on and off until stop is closed, a nil stop runs forever.
+func run(cfg *settings, stop <-chan struct{}) {
 	var err error
 	var network string
-	api, acc, nodeLog, pgKey := opts()
+	api, acc, notify, coord, producer, health, witnesses, primary := cfg.api, cfg.account, cfg.notify, cfg.coord, cfg.producer, cfg.health, cfg.witnesses, cfg.primary
+	signing := cfg.signing
 
 	gi, err := api.GetInfo()
 	if err != nil {
@@ -37,29 +58,59 @@ func main() {
 	default:
 		network = "unknown network"
 	}
+	notify.network = network
+	health.probe()
+
+	var active bool // tracks if currently top 21
+	paused := &pausedState{}
 
 	// make sure producer API is even available
-	paused, err = api.IsProducerPaused()
+	p, err := producer.IsPaused()
 	if err != nil {
+		stats.apiFailure("paused")
 		log.Fatal(err)
 	}
+	paused.set(p)
+
+	// a few restarts are expected, but if systemd keeps restarting this something is wrong
+	state := cfg.state
+	saved := state.get()
+	starts, err := state.started(time.Now(), cfg.limits.get().CrashWindow)
+	if err != nil {
+		log.Println("could not save state:", err)
+	}
+	if starts > cfg.limits.get().CrashRestarts {
+		msg := fmt.Sprintf("standby has restarted %d times in %v, paused: %v", starts-1, cfg.limits.get().CrashWindow, saved.Paused)
+		log.Println(msg)
+		notify.notify(alertCrashLoop, msg, "")
+	}
 
-	// always start paused, some danger in this if this program is repeatedly crashing, which is worse,
-	// missing blocks or double-producing blocks and causing many small forks?
-	if !paused {
-		paused = true
-		err = api.ProducerPause()
+	// Start paused unless the standby had taken over and nodeos is still producing, then only this process restarted.
+	// Pausing would miss blocks on every restart while the primary is down, and if the primary comes back the
+	// duplicate block detectors will still pause.
+	keep := !paused.get() && !saved.Paused
+	if keep {
+		if _, err = coord.acquire(); err != nil {
+			log.Println("was producing before restarting, but could not acquire the lease:", err)
+			keep = false
+		} else {
+			log.Printf("was producing before restarting (%s at %s), not pausing", saved.Reason, saved.Changed.Format(time.RFC3339))
+		}
+	}
+	if !paused.get() && !keep {
+		paused.set(true)
+		err = producer.Pause()
 		if err != nil {
+			stats.apiFailure("pause")
 			log.Println(err)
-			paused = false
+			paused.set(false)
+		} else if err = state.transition(true, "paused on startup", time.Now()); err != nil {
+			log.Println("could not save state:", err)
 		}
 	}
 
-	healthy := make(chan string)              // go routine heartbeat channel
 	lastHealthy := make(map[string]time.Time) // tracks last heartbeat for routines, if too long w/no heartbeat then bail
-	byOrder := make(chan bool)                // notifications for missing blocks
-	byRound := make(chan bool)                // notifications for missing entire rounds, in case missed block detection doesn't work
-	restored := make(chan bool)               // notification that other node is signing blocks, and to stop local production
+	events := make(chan event)                // detector notifications: missing blocks, restored primary, and heartbeats
 	failing := make(chan error)               // errors from routines, too many errors triggers a restart
 
 	// ensure the node is synced before doing anything
@@ -79,402 +130,726 @@ func main() {
 	}
 
 	// pass around a common block so multiple routines aren't hammering the endpoint.
-	block := &blockNumProd{}
+	block := &chainHead{}
+
+	// use multiple methods to watch for missed blocks. By default, one is by expecting blocks from our account before
+	// or after based on sorting in the schedule. Second is by watching for missed rounds based on reversible block
+	// states. Finally, seeing duplicate blocks signed by this key indicates the primary node is back online.
+	var neighbors = &neighbor{}
+	w := &watch{
+		account:   acc,
+		api:       api,
+		head:      block,
+		neighbors: neighbors,
+		isPaused:  paused.get,
+		logs:      cfg.logs,
+		match:     cfg.match,
+		peers:     cfg.peers,
+		limits:    cfg.limits,
+		primary:   cfg.primary,
+		stop:      stop,
+	}
+
+	pollInterval := cfg.pollInterval
+	if pollInterval == 0 {
+		pollInterval = time.Second
+	}
 	go func() {
-		info := &eos.InfoResp{}
-		b := &eos.BlockResp{}
-		var err error // intentional shadow
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
 		for {
-			time.Sleep(time.Second)
-			info, err = api.GetInfo()
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+			info, err := api.GetInfo()
 			if err != nil {
-				failing <- err
+				if !w.fail(failing, err) {
+					return
+				}
 				continue
 			}
-			block.BlockHeadTime = info.HeadBlockTime.Time
-			b, err = api.GetBlockByNum(info.HeadBlockNum)
+			health.observe(info.LastIrreversibleBlockNum, time.Now())
+			b, err := api.GetBlockByNum(info.HeadBlockNum)
 			if err != nil {
-				failing <- err
+				if !w.fail(failing, err) {
+					return
+				}
 				continue
 			}
 			if b == nil {
 				continue
 			}
-			block.BlockNum = b.BlockNum
-			block.Producer = string(b.Producer)
-			block.ScheduleVersion = b.ScheduleVersion
-			healthy <- "block updates"
+			block.set(blockNumProd{
+				Producer:        string(b.Producer),
+				BlockNum:        b.BlockNum,
+				BlockHeadTime:   info.HeadBlockTime.Time,
+				ScheduleVersion: b.ScheduleVersion,
+			})
+			if !w.send(events, event{Kind: eventHeartbeat, Source: "block updates"}) {
+				return
+			}
 		}
 	}()
+	// neighbors for the pending schedule are known before it takes effect
+	go trackSchedules(w, api, events, failing)
+	for _, d := range cfg.detect {
+		log.Println("starting detector:", d.Name())
+		go d.Start(w, events, failing)
+	}
 
-	// use two methods to watch for missed blocks. One is by expecting blocks from our account before or after
-	// based on sorting in the schedule. Second is by watching for missed rounds based on reversible block states.
-	// finally, seeing duplicate blocks signed by this key indicates the primary node is back online
+	// when running more than one standby, holding the lease is required to produce
+	go coord.keepAlive(w, events)
 
-	// if head is not incrementing, and the previous producer is immediately before this bp, it is missing blocks.
-	var neighbors = &neighbor{}
-	go missedByOrder(neighbors, block, acc, byOrder, healthy)
-
-	// checking order may not be reliable if multiple producers are missing rounds, this is a fallback that should find
-	// if this producer is missing entire rounds. Not ideal, but beats missing many rounds instead of just one.
-	go missedRound(block, api, acc, byRound, healthy, failing)
+	stats.account, stats.head = string(acc), block
+	if cfg.metricsListen != "" {
+		go stats.watchLastProduced(w)
+		go serveMetrics(cfg.metricsListen)
+	}
 
-	// if seeing blocks signed by this bp account then it's back online, stop producing. In this case, watch the nodeos log file
-	go duplicateSig(nodeLog, string(acc), restored, healthy, failing)
+	if cfg.recordFile != "" {
+		rec, err := newRecorder(cfg.recordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("recording to", cfg.recordFile)
+		go rec.run(w, api, events, failing)
+	}
 
 	var (
-		failcount int
-		unhealthy bool
+		failcount   int
+		unhealthy   bool
+		maintenance bool // suppresses automatic failover, set using the control API
 	)
 
-	startProducing := func() bool {
-		if unhealthy || !active || block.syncing() {
-			return false
+	// resume enables production, unless forced it will only resume if in the schedule and synced.
+	resume := func(force bool, reason string) error {
+		// the schedule may have changed since the last isTop21, use the one that produced the head block
+		head := block.get()
+		active = inSchedule(neighbors, head, active)
+		if !force && (unhealthy || !active || head.syncing()) {
+			return errors.New("not eligible to produce")
+		}
+		// a primary that says it's producing is never taken over, even if the chain makes it look gone
+		if !force && paused.get() {
+			if err := primary.veto(time.Now()); err != nil {
+				return errors.New("vetoed by heartbeat: " + err.Error())
+			}
+		}
+		// blocks we signed a moment ago mean the primary is alive, resuming now would fork
+		if !force && paused.get() {
+			if err := signedRecently(api, acc, cfg.limits.get().SignedWindow, time.Now()); err != nil {
+				return errors.New("primary may still be producing: " + err.Error())
+			}
+		}
+		// make sure it isn't only this node that can't see the primary
+		if !force && paused.get() {
+			if err := witnesses.confirm(acc, neighbors, time.Now()); err != nil {
+				return errors.New("not confirmed by witnesses: " + err.Error())
+			}
+		}
+		// the primary being gone doesn't help if our node can't produce either
+		if !force && paused.get() {
+			if err := health.check(time.Now()); err != nil {
+				notify.notify(alertUnhealthy, "standby node is not fit to produce: "+err.Error(), "")
+				return errors.New("node is not healthy: " + err.Error())
+			}
+		}
+		// even a forced resume is pointless if the node can't sign for the registered key
+		if paused.get() {
+			if err := signing.check(); err != nil {
+				notify.notify(alertKeyMismatch, "standby can't produce: "+err.Error(), "")
+				return errors.New("signing key check failed: " + err.Error())
+			}
+		}
+		token, err := coord.acquire()
+		if err != nil {
+			return errors.New("could not acquire lease: " + err.Error())
 		}
 		unhealthy = true
-		if paused {
-			err = api.ProducerResume()
+		if paused.get() {
+			// last check before resuming, ensure no other standby has taken over since getting the lease
+			if err = coord.fence(token); err != nil {
+				unhealthy = false
+				return err
+			}
+			err = producer.Resume()
 			if err != nil {
-				log.Println("could not resume producer: " + err.Error())
+				stats.apiFailure("resume")
 				unhealthy = false // force recheck next interval.
-				paused = true
-				if e := notifyPagerduty(false, "could not resume producer: " + err.Error(), string(acc), pgKey, network); e != nil {
-					log.Println(e)
-				}
+				paused.set(true)
+				notify.notify(alertResumeFailed, "could not resume producer: "+err.Error(), "")
+				return errors.New("could not resume producer: " + err.Error())
 			}
 			log.Println("enabled block production")
-			err = notifyPagerduty(false, "standby enabled block production", string(acc), pgKey, network)
-			if err != nil {
-				log.Println(err)
+			notify.notify(alertEnabled, "standby enabled block production", "")
+			paused.set(false)
+			if err = state.transition(false, reason, time.Now()); err != nil {
+				log.Println("could not save state:", err)
 			}
-			paused = false
+		}
+		return nil
+	}
+
+	startProducing := func(reason string) bool {
+		if err := resume(false, reason); err != nil {
+			log.Println("not enabling block production:", err)
+			return false
 		}
 		return true
 	}
 
-	topTick := time.NewTicker(time.Minute)
+	stopProducing := func(reason string) error {
+		if paused.get() {
+			return nil
+		}
+		log.Println("pausing block production")
+		err := producer.Pause()
+		if err != nil {
+			stats.apiFailure("pause")
+			log.Println(err)
+			notify.notify(alertPauseFailed, "standby producer could not stop production: "+err.Error(), "")
+			return err
+		}
+		paused.set(true)
+		unhealthy = false
+		coord.release()
+		log.Println("successfully paused block production")
+		notify.notify(alertPaused, reason, "")
+		if err = state.transition(true, reason, time.Now()); err != nil {
+			log.Println("could not save state:", err)
+		}
+		return nil
+	}
+
+	// status and control API for operators
+	commands := make(chan controlCommand)
+	if cfg.controlListen != "" {
+		go func() {
+			log.Println("control API listening on", cfg.controlListen)
+			log.Fatal(http.ListenAndServe(cfg.controlListen, controlHandler(cfg.controlToken, commands)))
+		}()
+	}
+
+	// thresholds and notifiers are reloaded on SIGHUP, nothing else is affected
+	hup := make(chan os.Signal, 1)
+	if cfg.configFile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	topInterval := cfg.topInterval
+	if topInterval == 0 {
+		topInterval = time.Minute
+	}
+	topTick := time.NewTicker(topInterval)
+	defer topTick.Stop()
+
+	// fail counts an error, too many in a row and the standby exits. Only heartbeats reset the count.
+	fail := func(err error) {
+		failcount += 1
+		if failcount > cfg.limits.get().MaxFailures {
+			// anticipated this is running in a container or under systemd control, and will be restarted.
+			log.Fatal("too many failed checks, exiting: " + err.Error())
+		}
+		log.Println(err)
+	}
 
 	active, err = isTop21(neighbors, api, acc)
+
+	// nodeos restarted paused while the standby was producing, pick up where it left off if the primary is still gone
+	if paused.get() && !saved.Paused {
+		for wait := time.Now().Add(30 * time.Second); block.get().BlockNum == 0 && time.Now().Before(wait); {
+			time.Sleep(100 * time.Millisecond)
+		}
+		distance, err := lastProduced(api, acc, block.get().BlockNum)
+		switch {
+		case err != nil:
+			log.Println("was producing before restarting, could not check for the primary:", err)
+		case distance < 0 || distance >= int64(cfg.limits.get().MissedRoundBlocks):
+			log.Printf("was producing before restarting, %s has not produced since, resuming", acc)
+			startProducing("standby was producing before restarting, primary is still missing")
+		default:
+			log.Printf("was producing before restarting, but %s produced %d blocks ago, leaving it to the detectors", acc, distance)
+		}
+		if paused.get() {
+			if err = state.transition(true, "paused on startup", time.Now()); err != nil {
+				log.Println("could not save state:", err)
+			}
+		}
+	}
+
 	for {
+		stats.setState(paused.get(), active, maintenance)
 		select {
-		case <-restored:
-			if !paused {
-				log.Println("pausing block production")
-				err = api.ProducerPause()
-				if err != nil {
-					log.Println(err)
-					err = notifyPagerduty(false, "standby producer could not stop production", string(acc), pgKey, network)
-					if err != nil {
-						log.Println(err)
-					}
+		case ev := <-events:
+			if ev.Kind != eventHeartbeat {
+				stats.trigger(ev)
+			}
+			switch ev.Kind {
+			case eventHeartbeat:
+				failcount = 0
+				lastHealthy[ev.Source] = time.Now()
+				stats.heartbeat(ev.Source, lastHealthy[ev.Source])
+
+			case eventMissing:
+				if maintenance {
+					log.Printf("%s %s (%s), in maintenance mode, not enabling block production", acc, ev.Reason, ev.Source)
 					continue
 				}
-				paused = true
-				log.Println("successfully paused block production")
-				err = notifyPagerduty(true, "standby producer shutting down, primary is back", string(acc), pgKey, network)
-				if err != nil {
-					log.Println(err)
+				if startProducing(ev.Reason) {
+					log.Println(acc, ev.Reason)
 				}
-			}
 
-		case <-byOrder:
-			if startProducing() {
-				log.Println(acc, "has missed blocks.")
+			case eventRestored:
+				_ = stopProducing("standby producer shutting down, primary is back")
 			}
 
-		case <-byRound:
-			if startProducing() {
-				log.Println(acc, "has missed a round.")
+		case cmd := <-commands:
+			var err error
+			switch cmd.action {
+			case controlPause:
+				log.Println("control API: pause requested")
+				err = stopProducing("standby producer paused by operator")
+			case controlResume:
+				log.Println("control API: resume requested")
+				err = resume(true, "resumed by operator")
+			case controlMaintenance:
+				log.Println("control API: setting maintenance mode to", cmd.enable)
+				maintenance = cmd.enable
+			}
+			head := block.get()
+			before, after := neighbors.get()
+			saved := state.get()
+			st := &standbyStatus{
+				Account:     string(acc),
+				Network:     network,
+				Active:      active,
+				Paused:      paused.get(),
+				Maintenance: maintenance,
+				Unhealthy:   unhealthy,
+				Failcount:   failcount,
+				HeadBlock:   head.BlockNum,
+				HeadTime:    head.BlockHeadTime,
+				Before:      before,
+				After:       after,
+				Failovers:   saved.Failovers,
+				Changed:     saved.Changed,
+				Reason:      saved.Reason,
+				LastHealthy: make(map[string]time.Time),
+			}
+			for k, v := range lastHealthy {
+				st.LastHealthy[k] = v
 			}
+			if beat, seen, live := primary.get(time.Now()); seen {
+				st.Primary = &primaryStatus{Live: live, Paused: beat.Paused, HeadBlock: beat.HeadBlock, Sent: beat.Sent}
+			}
+			cmd.reply <- controlReply{status: st, err: err}
+
+		case err := <-failing:
+			fail(err)
 
-		case h := <-healthy:
-			failcount = 0
-			lastHealthy[h] = time.Now()
+		case <-stop:
+			return
 
-		case fail := <-failing:
-			failcount += 1
-			if failcount > 10 {
-				// anticipated this is running in a container or under systemd control, and will be restarted.
-				log.Fatal("too many failed checks, exiting: " + fail.Error())
+		case <-hup:
+			n, err := cfg.reload()
+			if err != nil {
+				log.Println("could not reload config, keeping current settings:", err)
+				continue
 			}
-			log.Println(fail)
+			n.network, n.sent = notify.network, notify.sent
+			notify = n
+			log.Printf("reloaded %s, thresholds: %+v", cfg.configFile, cfg.limits.get())
 
 		// track our state, are this bp in the top 21, is production currently paused?
 		case <-topTick.C:
+			// this loop is the only reader of failing, sending to it here would block forever
 			active, err = isTop21(neighbors, api, acc)
 			if err != nil {
-				failing <- err
+				fail(err)
 			}
-			paused, err = api.IsProducerPaused()
-			if err != nil {
-				failing <- err
+			active = inSchedule(neighbors, block.get(), active)
+			if p, err := producer.IsPaused(); err != nil {
+				stats.apiFailure("paused")
+				fail(err)
+			} else {
+				paused.set(p)
 			}
 			// check for dead routines, exit if dead
 			for rtn := range lastHealthy {
-				if lastHealthy[rtn].Before(time.Now().Add(-5 * time.Minute)) {
-					log.Fatalf("FATAL: %s routine hasn't sent a heartbeat for %v, exiting.", rtn, time.Now().Sub(lastHealthy[rtn]))
+				if lastHealthy[rtn].Before(time.Now().Add(-cfg.limits.get().HeartbeatTimeout)) {
+					msg := fmt.Sprintf("%s routine hasn't sent a heartbeat for %v, exiting.", rtn, time.Now().Sub(lastHealthy[rtn]))
+					notify.notify(alertDeadRoutine, msg, rtn)
+					notify.wait()
+					log.Fatal("FATAL: " + msg)
 				}
 			}
 		}
 	}
 }
 
-type neighbor struct {
-	Before string
-	After  string
+func isTop21(neighbors *neighbor, api *fio.API, prod eos.AccountName) (active bool, err error) {
+	ps, err := api.GetProducerSchedule()
+	if err != nil {
+		return
+	}
+	prods := make([]string, len(ps.Active.Producers))
+	for i, bps := range ps.Active.Producers {
+		prods[i] = string(bps.AccountName)
+	}
+	before, after, active := sortedNeighbors(prods, string(prod))
+	if active {
+		neighbors.set(before, after)
+	}
+	return active, err
 }
 
-type blockNumProd struct {
-	Producer        string
-	BlockNum        uint32
-	BlockHeadTime   time.Time
-	ScheduleVersion uint32
+// settings are the command line options
+type settings struct {
+	api           *fio.API
+	account       eos.AccountName
+	logFile       string
+	logSource     string
+	logs          *logHub
+	match         *logMatcher
+	notify        *notifiers
+	detect        []Detector
+	coord         *coordinator
+	controlListen string
+	controlToken  string
+	metricsListen string
+	recordFile    string
+	peers         []chainReader
+	producer      producerSwitch
+	limits        *tuning
+	stateFile     string
+	state         *stateStore
+	health        *nodeHealth
+	witnesses     *witnesses
+	primary       *primaryWatch
+	signing       *signingCheck
+	topInterval   time.Duration // how often to check the active schedule and paused state, default 1m
+	pollInterval  time.Duration // how often to get the head block, default 1s
+
+	configFile  string
+	config      *fileConfig       // config file as it was when starting, for reloading
+	notifySpecs []string          // notifiers from the command line
+	severity    map[string]string // severities from the command line
 }
 
-func (b blockNumProd) syncing() bool {
-	if b.BlockHeadTime.Before(time.Now().Add(-time.Minute)) {
-		return true
+func opts() *settings {
+	var err error
+	fatal := func(e error) {
+		if e != nil {
+			log.Fatal(e)
+		}
 	}
-	return false
-}
 
-func missedByOrder(neighbors *neighbor, block *blockNumProd, bp eos.AccountName, missing chan bool, healthy chan string) {
-	for neighbors.Before == "" || block == nil || block.syncing() {
-		time.Sleep(5 * time.Second)
-		log.Println("missed block detection not started, waiting for data")
-	}
-	log.Println("watching for missed blocks")
+	cfg := &settings{}
+	var a, url, d, leaseUrl, leaseListen, leaseSecret, id, replayFile, peers, pgKey, sev string
+	var notify multiFlag
+	var leaseTtl time.Duration
+	var leaseOnly bool
+	var failover, standbyKey, primaryKey, wif, perm, logMatch string
+	var handoverUrl, handbackUrl string
+	var handoverTimeout time.Duration
+	var witnessUrls string
+	var quorum int
+	var agentUrls, heartbeatListen, heartbeatSecret string
+	var signingKeys, nodeosConfig string
+	flag.StringVar(&cfg.configFile, "config", "", "YAML config file, reloaded on SIGHUP, command line options override the file, optional")
+	flag.StringVar(&url, "u", "http://127.0.0.1:8888", "nodeos API to connect to")
+	flag.StringVar(&a, "a", "", "producer account to watch for")
+	flag.StringVar(&cfg.logFile, "f", "/var/log/fio/nodeos.log", "nodeos log file for detecting duplicate blocks")
+	flag.StringVar(&cfg.logSource, "log", "", "where to read the nodeos log, one of: 'file:<path>', 'stdin', 'journalctl:<unit>', 'docker:<container>' (default file:<-f>)")
+	flag.StringVar(&logMatch, "log-match", "", "regex for duplicate block errors in the nodeos log, the account is the group named 'account' or the first group (default '"+defaultLogMatch+"')")
+	flag.StringVar(&pgKey, "pager", "", "PagerDuty API key for notifications, optional, same as '-notify pagerduty:<key>'")
+	flag.Var(&notify, "notify", "send notifications, '<type>:<target>[#kind,severity]', can be repeated. Types: pagerduty, slack, discord, matrix, webhook, smtp")
+	flag.StringVar(&sev, "severity", "", "override alert severities, ex: 'enabled=critical,paused=warning'")
+	flag.StringVar(&d, "detect", "", "comma separated list of detectors to run, one or more of: "+strings.Join(detectorOrder, ",")+" (default "+strings.Join(detectorDefaults, ",")+")")
+	flag.StringVar(&peers, "fork-endpoints", "", "comma separated list of independent nodeos APIs, enables the 'fork' detector for finding duplicate blocks without the log file")
+	flag.StringVar(&witnessUrls, "witnesses", "", "comma separated list of independent nodeos APIs that have to agree the producer is missing before resuming, optional")
+	flag.IntVar(&quorum, "quorum", 0, "number of witnesses that have to agree the producer is missing (default majority)")
+	flag.StringVar(&heartbeatListen, "heartbeat-listen", "", "receive heartbeats from the agent on the primary on this address, ex: ':8083', optional")
+	flag.StringVar(&heartbeatSecret, "heartbeat-secret", os.Getenv("HEARTBEAT_SECRET"), "shared secret for signing heartbeats, can also be set with HEARTBEAT_SECRET env var")
+	flag.StringVar(&agentUrls, "agent", "", "run as the agent on the primary, sending heartbeats to the standby's '-heartbeat-listen' at these comma separated urls")
+	flag.StringVar(&leaseUrl, "lease", "", "shared lease for multiple standby nodes, file:///path/on/shared/storage or http(s)://lease-server:port, optional")
+	flag.StringVar(&leaseListen, "lease-listen", "", "serve a lease to other standby nodes on this address, ex: ':8081', optional")
+	flag.StringVar(&leaseSecret, "lease-secret", os.Getenv("LEASE_SECRET"), "shared secret for the lease server, required with -lease-listen, can also be set with LEASE_SECRET env var")
+	flag.DurationVar(&leaseTtl, "lease-ttl", 30*time.Second, "how long the lease is valid without being renewed")
+	flag.BoolVar(&leaseOnly, "lease-only", false, "only run the lease server, do not watch a producer")
+	flag.StringVar(&id, "id", "", "unique name for this standby when using a lease (default hostname)")
+	flag.StringVar(&failover, "failover", "api", "how to enable production: 'api' uses the local producer api, 'key' registers the standby's signing key on-chain (needs -heartbeat-listen)")
+	flag.StringVar(&standbyKey, "standby-key", "", "public signing key of the standby node, required with '-failover key'")
+	flag.StringVar(&primaryKey, "primary-key", "", "public signing key of the primary node, used with '-failover key' (default currently registered key)")
+	flag.StringVar(&wif, "wif", os.Getenv("WIF"), "private key for the delegated regproducer permission, used with '-failover key', can also be set with WIF env var")
+	flag.StringVar(&perm, "permission", os.Getenv("PERM"), "delegated permission linked to eosio::regproducer, used with '-failover key', can also be set with PERM env var")
+	flag.StringVar(&signingKeys, "signing-key", "", "comma separated public keys in the node's signature-provider, checked against the on-chain key before resuming, optional")
+	flag.StringVar(&nodeosConfig, "nodeos-config", "", "nodeos config.ini to read the signature-provider keys from, checked against the on-chain key before resuming, optional")
+	flag.StringVar(&cfg.controlListen, "api", "", "listen address for the status and control API, ex: '127.0.0.1:8082', optional")
+	flag.StringVar(&cfg.controlToken, "api-token", os.Getenv("API_TOKEN"), "bearer token required for the control API, can also be set with API_TOKEN env var")
+	flag.StringVar(&cfg.metricsListen, "metrics", "", "listen address for prometheus metrics, ex: ':9100', optional")
+	flag.StringVar(&cfg.stateFile, "state", "", "file to save the production state in, so a restart doesn't pause a standby that has taken over, optional")
+	flag.StringVar(&cfg.recordFile, "record", "", "record the block stream and nodeos log to this file for later replay, optional")
+	flag.StringVar(&replayFile, "replay", "", "replay a recording, print when production would have been resumed or paused, and exit")
+	flag.StringVar(&handoverUrl, "handover", "", "move production from the primary's producer api at this url to the standby between our slots, and exit")
+	flag.StringVar(&handbackUrl, "handback", "", "move production from the standby back to the primary's producer api at this url between our slots, and exit")
+	flag.DurationVar(&handoverTimeout, "handover-timeout", 5*time.Minute, "how long a handover waits for our slot, and for the new node to produce")
+	flag.Parse()
 
-	var produced, wereNext, busy bool
-	var missedCounter int
-	lastBlock := block.BlockNum - 1
-	t := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-t.C:
-			if busy || block.syncing() {
-				continue
-			}
-			busy = true
-			healthy <- "missed blocks"
-			if !paused {
-				busy = false
-				continue
-			}
-			switch block.Producer {
-			case neighbors.Before:
-				wereNext = true
-				produced = false
-			case string(bp):
-				wereNext = false
-				produced = true
-				missedCounter = 0
-			case neighbors.After:
-				if !produced && wereNext {
-					// missed the entire round!
-					log.Printf("%s was scheduled to be next, but did not produce\n", bp)
-					missing <- true
-					wereNext = false
-				}
-			}
-			if block.BlockNum == lastBlock {
-				log.Println("block not incrementing", lastBlock, "last producer", block.Producer)
-				if wereNext {
-					missedCounter += 1
-				}
-			}
-			lastBlock = block.BlockNum
-			// this would be 4 missed blocks
-			if missedCounter > 2 {
-				log.Printf("head block failed to increment for ~4 blocks during the schedule for %s, declaring as missing", bp)
-				missing <- true
-				wereNext = false
-			}
-			busy = false
+	// the config file only supplies values that weren't set on the command line
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	cfg.config = &fileConfig{Thresholds: defaultThresholds()}
+	if cfg.configFile != "" {
+		cfg.config, err = loadConfig(cfg.configFile)
+		fatal(err)
+		fc := cfg.config
+		if fc.Url != "" && !explicit["u"] {
+			url = fc.Url
+		}
+		if fc.Account != "" && !explicit["a"] {
+			a = fc.Account
+		}
+		if fc.LogFile != "" && !explicit["f"] {
+			cfg.logFile = fc.LogFile
+		}
+		if fc.LogSource != "" && !explicit["log"] {
+			cfg.logSource = fc.LogSource
+		}
+		if fc.LogMatch != "" && !explicit["log-match"] {
+			logMatch = fc.LogMatch
+		}
+		if fc.StateFile != "" && !explicit["state"] {
+			cfg.stateFile = fc.StateFile
+		}
+		if len(fc.ForkEndpoints) > 0 && !explicit["fork-endpoints"] {
+			peers = strings.Join(fc.ForkEndpoints, ",")
+		}
+		if len(fc.Witnesses) > 0 && !explicit["witnesses"] {
+			witnessUrls = strings.Join(fc.Witnesses, ",")
+		}
+		if fc.Quorum != 0 && !explicit["quorum"] {
+			quorum = fc.Quorum
+		}
+		if fc.HeartbeatListen != "" && !explicit["heartbeat-listen"] {
+			heartbeatListen = fc.HeartbeatListen
+		}
+		if len(fc.SigningKeys) > 0 && !explicit["signing-key"] {
+			signingKeys = strings.Join(fc.SigningKeys, ",")
+		}
+		if fc.NodeosConfig != "" && !explicit["nodeos-config"] {
+			nodeosConfig = fc.NodeosConfig
+		}
+		if len(fc.Detect) > 0 && !explicit["detect"] {
+			d = strings.Join(fc.Detect, ",")
 		}
 	}
-}
+	cfg.limits = newTuning(cfg.config.Thresholds)
+	if cfg.state, err = loadState(cfg.stateFile); err != nil {
+		log.Println("could not read state, starting paused:", err)
+	}
 
-func missedRound(block *blockNumProd, api *fio.API, bp eos.AccountName, missing chan bool, healthy chan string, failed chan error) {
-	for block == nil || block.syncing() {
-		time.Sleep(time.Second)
-		log.Println("missed round detection not started, waiting for data")
+	if cfg.controlListen != "" && cfg.controlToken == "" {
+		log.Fatal("the control API requires a token, set '-api-token' or the API_TOKEN env var")
 	}
-	log.Println("watching for missed rounds")
 
-	var lastScheduleVer, lastScheduleLib uint32
-	for {
-		time.Sleep(6 * time.Second)
-		healthy <- "missed rounds"
-		if !paused || block.ScheduleVersion <= lastScheduleVer {
-			continue
+	var backend leaseBackend
+	if leaseListen != "" {
+		if leaseSecret == "" {
+			log.Fatal("the lease server requires a secret, set '-lease-secret' or the LEASE_SECRET env var")
 		}
-		lastScheduleVer = block.ScheduleVersion
-
-		bhs, err := api.GetBlockHeaderState(block.BlockNum)
-		if err != nil {
-			failed <- err
-			continue
-		}
-		if bhs.PendingSchedule == nil || block.syncing() {
-			// may not be synced
-			time.Sleep(time.Minute)
-			continue
+		server := &memLease{}
+		listen := func() {
+			log.Println("serving lease on", leaseListen)
+			log.Fatal(http.ListenAndServe(leaseListen, leaseHandler(server, leaseSecret)))
 		}
-		// ensure at least a full round on this schedule before checking
-		if bhs.PendingSchedule.ScheduleLibNum != lastScheduleLib {
-			gsb := &eos.BlockResp{}
-			gsb, err = api.GetBlockByNum(bhs.PendingSchedule.ScheduleLibNum)
-			if err != nil {
-				failed <- err
-				continue
-			}
-			if time.Now().Before(gsb.SignedBlockHeader.Timestamp.Time.Add(6 * time.Minute)) {
-				// not long enough to declare missing....
-				continue
-			}
-			lastScheduleLib = bhs.PendingSchedule.ScheduleLibNum
+		if leaseOnly {
+			listen()
 		}
-		if ok, lp := bhs.ProducerToLast(fio.ProducerToLastProduced); ok {
-			for _, prod := range lp {
-				if string(prod.Producer) == string(bp) && prod.BlockNum < block.BlockNum-(21*13) {
-					log.Printf("detected %s has missed a round, last produced on %d, %d blocks ago\n", bp, prod.BlockNum, block.BlockNum-prod.BlockNum)
-					missing <- true
-				}
-			}
+		go listen()
+		backend = server
+	}
+	if leaseUrl != "" {
+		backend, err = newLeaseBackend(leaseUrl, leaseSecret)
+		fatal(err)
+	}
+	if backend != nil {
+		if id == "" {
+			id, err = os.Hostname()
+			fatal(err)
 		}
+		cfg.coord = newCoordinator(backend, id, leaseTtl)
+		log.Printf("using lease as '%s'", id)
 	}
-}
 
-// duplicateSig watches the nodeos stdout logs for duplicate blocks by the same producer, these will be rejected
-// with a 'Block not applied to head' error. This isn't a 100% guarantee that there aren't two active nodes
-// producing blocks with the same key, if a block is empty both producers will create identical blocks. This should
-// catch it pretty quick though.
-func duplicateSig(file string, bp string, restored chan bool, healthy chan string, failed chan error) {
-	t, err := tail.TailFile(file, tail.Config{
-		Follow:    true,
-		ReOpen:    true,
-		MustExist: true,
-		Location: &tail.SeekInfo{
-			Offset: 0,
-			Whence: 2,
-		},
-	})
-	if err != nil {
-		log.Fatal(err)
+	if len(a) != 12 {
+		log.Fatal("account '-a' should be 12 characters")
 	}
-	defer t.Cleanup()
-
-	healthTick := time.NewTicker(time.Minute)
-	var last time.Time
-	re := regexp.MustCompile(`Block not applied to head.*signed by (\w{12})`)
+	cfg.account = eos.AccountName(a)
 
-	for {
-		select {
-		case <-t.Dead():
-			failed <- errors.New("log watcher died")
+	if (agentUrls != "" || heartbeatListen != "") && heartbeatSecret == "" {
+		log.Fatal("heartbeats require a secret, set '-heartbeat-secret' or the HEARTBEAT_SECRET env var")
+	}
+	if agentUrls != "" {
+		agentApi, err := agentApi(url)
+		fatal(err)
+		runAgent(agentApi, cfg.account, strings.Split(agentUrls, ","), heartbeatSecret, time.Second)
+	}
 
-		case line := <-t.Lines:
-			if match := re.FindStringSubmatch(line.Text); len(match) > 1 && match[1] == bp {
-				log.Println(match[1], "produced a duplicate block")
-				restored <- true
+	cfg.notifySpecs = notify
+	if pgKey != "" {
+		cfg.notifySpecs = append(cfg.notifySpecs, "pagerduty:"+pgKey)
+	}
+	cfg.severity = make(map[string]string)
+	if sev != "" {
+		for _, kv := range strings.Split(sev, ",") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				log.Fatal("invalid severity override: " + kv)
 			}
-			last = line.Time
+			cfg.severity[parts[0]] = parts[1]
+		}
+	}
+	cfg.notify, err = buildNotifiers(a, append(cfg.config.Notify, cfg.notifySpecs...), cfg.config.Severity, cfg.severity)
+	fatal(err)
 
-		case <-healthTick.C:
-			if last.After(time.Now().Add(-1 * time.Minute)) {
-				healthy <- "log watcher"
-			}
+	// optional detectors are added to the defaults when they are configured
+	optional := make([]string, 0)
+	if peers != "" {
+		for _, u := range strings.Split(peers, ",") {
+			cfg.peers = append(cfg.peers, &fio.API{API: eos.New(strings.TrimSpace(u))})
 		}
+		optional = append(optional, "fork")
 	}
-}
+	if heartbeatListen != "" {
+		cfg.primary = newPrimaryWatch(cfg.account, heartbeatSecret, cfg.limits)
+		optional = append(optional, "heartbeat")
+	}
+	if d == "" && len(optional) > 0 {
+		d = strings.Join(append(append([]string{}, detectorDefaults...), optional...), ",")
+	}
+	cfg.detect, err = newDetectors(d)
+	fatal(err)
 
-func isTop21(neighbors *neighbor, api *fio.API, prod eos.AccountName) (active bool, err error) {
-	ps, err := api.GetProducerSchedule()
-	if err != nil {
-		return
+	var wl []string
+	if witnessUrls != "" {
+		wl = strings.Split(witnessUrls, ",")
 	}
-	prods := make([]string, len(ps.Active.Producers))
-	for i, bps := range ps.Active.Producers {
-		if string(bps.AccountName) == string(prod) {
-			active = true
-		}
-		prods[i] = string(bps.AccountName)
+	cfg.witnesses, err = newWitnesses(wl, quorum, cfg.limits)
+	fatal(err)
+
+	if replayFile != "" {
+		os.Exit(runReplay(replayFile, cfg.account, cfg.detect, cfg.limits))
 	}
-	if active {
-		sort.Strings(prods)
-		for i, p := range prods {
-			if p == string(prod) {
-				switch i {
-				case 0:
-					neighbors.Before = prods[len(prods)-1]
-					neighbors.After = prods[i+1]
-				case len(prods) - 1:
-					neighbors.Before = prods[i-1]
-					neighbors.After = prods[0]
-				default:
-					neighbors.Before = prods[i-1]
-					neighbors.After = prods[i+1]
-				}
-			}
+
+	switch failover {
+	case "api":
+		cfg.api, _, err = fio.NewConnection(nil, url)
+		fatal(err)
+		cfg.producer = &localSwitch{api: cfg.api}
+		// will error if /v1/producer api is not enabled.
+		_, err = cfg.api.IsProducerPaused()
+		fatal(err)
+	case "key":
+		if wif == "" {
+			log.Fatal("'-failover key' requires the private key for the delegated permission, set '-wif' or the WIF env var")
 		}
+		_, cfg.api, _, err = fio.NewWifConnect(wif, url)
+		fatal(err)
+		fatal(keyRecovery(cfg.detect, cfg.primary))
+		cfg.producer, err = newKeySwitch(cfg.api, cfg.account, perm, standbyKey, primaryKey)
+		fatal(err)
+	default:
+		log.Fatal("'-failover' should be 'api' or 'key'")
 	}
-	return active, err
-}
 
-func opts() (api *fio.API, account eos.AccountName, logFile string, pagerdutyKey string) {
-	var err error
-	fatal := func(e error) {
-		if e != nil {
-			log.Fatal(e)
+	if handoverUrl != "" || handbackUrl != "" {
+		switch {
+		case handoverUrl != "" && handbackUrl != "":
+			log.Fatal("use either '-handover' or '-handback', not both")
+		case failover != "api":
+			log.Fatal("'-handover' needs '-failover api', a key change already takes effect between rounds")
+		}
+		if handoverUrl != "" {
+			os.Exit(runHandover(cfg, handoverUrl, false, handoverTimeout))
 		}
+		os.Exit(runHandover(cfg, handbackUrl, true, handoverTimeout))
 	}
 
-	var a, url string
-	flag.StringVar(&url, "u", "http://127.0.0.1:8888", "nodeos API to connect to")
-	flag.StringVar(&a, "a", "", "producer account to watch for")
-	flag.StringVar(&logFile, "f", "/var/log/fio/nodeos.log", "nodeos log file for detecting duplicate blocks")
-	flag.StringVar(&pagerdutyKey, "pager", "", "PagerDuty API key for notifications, optional")
-	flag.Parse()
-
-	api, _, err = fio.NewConnection(nil, url)
-	fatal(err)
-	// will error if /v1/producer api is not enabled.
-	_, err = api.IsProducerPaused()
+	var keys []string
+	if signingKeys != "" {
+		for _, k := range strings.Split(signingKeys, ",") {
+			keys = append(keys, strings.TrimSpace(k))
+		}
+	}
+	expected := func() (string, error) {
+		return producerKey(cfg.api, cfg.account)
+	}
+	if ks, ok := cfg.producer.(*keySwitch); ok {
+		expected = func() (string, error) {
+			return ks.standbyKey, nil
+		}
+	}
+	cfg.signing, err = newSigningCheck(keys, nodeosConfig, expected)
 	fatal(err)
+	if err = cfg.signing.check(); err != nil {
+		log.Println("WARNING: resuming will fail,", err)
+	}
 
-	if len(a) != 12 {
-		log.Fatal("account '-a' should be 12 characters")
+	if cfg.primary != nil {
+		go func() {
+			log.Println("receiving heartbeats from the primary on", heartbeatListen)
+			log.Fatal(http.ListenAndServe(heartbeatListen, heartbeatHandler(cfg.primary)))
+		}()
 	}
-	account = eos.AccountName(a)
 
-	f, err := os.OpenFile(logFile, os.O_RDONLY, 0644)
-	fatal(err)
-	_, err = f.Stat()
+	// the head is compared with the fork endpoints, or the witnesses if there are none
+	refs := wl
+	if peers != "" {
+		refs = strings.Split(peers, ",")
+	}
+	cfg.health = newNodeHealth(cfg.api, refs, cfg.limits)
+
+	// only need the log if watching or recording it
+	cfg.match, err = newLogMatcher(logMatch)
 	fatal(err)
+	needLog := cfg.recordFile != ""
+	for _, dd := range cfg.detect {
+		if _, ok := dd.(*duplicateDetector); ok {
+			needLog = true
+		}
+	}
+	if needLog {
+		if cfg.logSource == "" {
+			cfg.logSource = "file:" + cfg.logFile
+		}
+		source, err := newLogSource(cfg.logSource)
+		fatal(err)
+		if fs, ok := source.(*fileSource); ok {
+			f, err := os.OpenFile(fs.path, os.O_RDONLY, 0644)
+			fatal(err)
+			_, err = f.Stat()
+			fatal(err)
+			_ = f.Close()
+		}
+		cfg.logs = newLogHub(source)
+	}
 
-	return
+	return cfg
 }
 
-func notifyPagerduty(resolved bool, message string, producer string, key string, network string) (err error) {
-	if key == "" {
-		return nil
-	}
-	action := "trigger"
-	sev := "error"
-	if resolved {
-		action = "resolve"
-		sev = "info"
-	}
-	_, err = pagerduty.ManageEvent(pagerduty.V2Event{
-		RoutingKey: key,
-		Action:     action,
-		DedupKey:   producer,
-		Payload:    &pagerduty.V2Payload{
-			Summary:   network+" "+message,
-			Source:    producer,
-			Severity:  sev,
-		},
-	})
-	return
+// multiFlag is a flag that can be repeated
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, " ")
+}
+
+func (m *multiFlag) Set(s string) error {
+	*m = append(*m, s)
+	return nil
 }
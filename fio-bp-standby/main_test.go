@@ -1,6 +1,9 @@
 package main
 
 import (
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
 	"os"
 	"testing"
 	"time"
@@ -11,17 +14,163 @@ func TestNotify(t *testing.T) {
 	if key == "" {
 		t.SkipNow()
 	}
+	pd := &pagerdutyNotifier{key: key}
 
-	err := notifyPagerduty(false, "testing trigger", "test-alert", key, "go test")
+	err := pd.Notify(alert{Severity: "error", Account: "test-alert", Network: "go test", Message: "testing trigger", DedupKey: "test-alert"})
 	if err != nil {
 		t.Error(err)
 	}
 
-	time.Sleep(3*time.Second)
+	time.Sleep(3 * time.Second)
 
-	err = notifyPagerduty(true, "testing resolve", "test-alert", key, "go test")
+	err = pd.Notify(alert{Severity: "info", Resolved: true, Account: "test-alert", Network: "go test", Message: "testing resolve", DedupKey: "test-alert"})
 	if err != nil {
 		t.Error(err)
 	}
 
 }
+
+// mockSettings runs the standby against a mock nodeos with only the order detector, and a short missed increment
+// threshold to match the mock's shorter turns. The head is polled and checked once a slot.
+func mockSettings(t *testing.T, m *mockNodeos) *settings {
+	t.Helper()
+	th := defaultThresholds()
+	th.MissedIncrements = 2
+	cfg := &settings{
+		api:          m.api(),
+		account:      eos.AccountName(m.account),
+		limits:       newTuning(th),
+		topInterval:  time.Second,
+		pollInterval: m.slot,
+		detect:       []Detector{&orderDetector{interval: m.slot}},
+	}
+	cfg.producer = &localSwitch{api: cfg.api}
+	cfg.state, _ = loadState("")
+	cfg.notify = newNotifiers(m.account)
+	if err := cfg.notify.add("webhook:" + m.URL + "/alerts"); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// waitUntil polls ok until it's true or the timeout passes
+func waitUntil(timeout time.Duration, ok func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if ok() {
+			return true
+		}
+	}
+	return ok()
+}
+
+func TestRunFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the standby for a few rounds")
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		name         string
+		schedule     []string
+		startAt      string // the producer whose turn starts the chain
+		primaryTurns int    // how many turns the primary produces before stopping
+	}{
+		// first in sorted order, the producer before us wraps around to the last one. The primary produces our
+		// whole turn, then stops and the standby takes over on the next round.
+		{name: "first", schedule: []string{"zproducer111", testBp, "tproducer111"}, startAt: testBp, primaryTurns: 1},
+		// last in sorted order, the producer after us wraps around to the first one
+		{name: "last", schedule: []string{"nproducer111", testBp, "aproducer111"}, startAt: "nproducer111"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockNodeos(testBp, tc.schedule...)
+			defer m.Close()
+			m.set(func(m *mockNodeos) {
+				m.slot = 100 * time.Millisecond
+				for i := range m.schedule {
+					if m.schedule[i] == tc.startAt {
+						m.start, m.slots = time.Now().Add(-time.Duration(i*m.perTurn)*m.slot), i*m.perTurn
+					}
+				}
+			})
+
+			stop := make(chan struct{})
+			defer close(stop)
+			go run(mockSettings(t, m), stop)
+
+			// the primary produces its turn, no failover
+			if tc.primaryTurns > 0 {
+				time.Sleep(time.Duration(tc.primaryTurns*m.perTurn) * m.slot)
+				if n := m.called("/v1/producer/resume"); n != 0 {
+					t.Fatalf("resumed %d times while the primary was producing", n)
+				}
+			}
+			m.set(func(m *mockNodeos) { m.primaryUp = false })
+
+			// stalls on our next turn, the standby takes over and signs the rest of it
+			standbySigned := func() bool {
+				m.mux.Lock()
+				defer m.mux.Unlock()
+				for _, b := range m.blocks {
+					if b.standby {
+						return true
+					}
+				}
+				return false
+			}
+			if !waitUntil(time.Duration(4*len(tc.schedule)*m.perTurn)*m.slot, standbySigned) {
+				t.Fatal("standby did not take over, resume was called", m.called("/v1/producer/resume"), "times")
+			}
+			// alerts are sent in the background
+			waitUntil(time.Second, func() bool {
+				m.mux.Lock()
+				defer m.mux.Unlock()
+				return len(m.alerts) > 0
+			})
+			m.mux.Lock()
+			defer m.mux.Unlock()
+			if m.doubleSigned > 0 {
+				t.Errorf("%d blocks were double signed", m.doubleSigned)
+			}
+			if m.calls["/v1/producer/resume"] != 1 {
+				t.Errorf("expected 1 resume, got %d", m.calls["/v1/producer/resume"])
+			}
+			if len(m.alerts) != 1 || m.alerts[0].Kind != alertEnabled || m.alerts[0].Network != "testnet" {
+				t.Errorf("expected an enabled alert on testnet, got %+v", m.alerts)
+			}
+		})
+	}
+}
+
+func TestIsTop21(t *testing.T) {
+	for _, tc := range []struct {
+		schedule      []string
+		before, after string
+		active        bool
+	}{
+		{schedule: []string{"zproducer111", testBp, "tproducer111"}, before: "zproducer111", after: "tproducer111", active: true},
+		{schedule: []string{"aproducer111", testBp, "zproducer111"}, before: "aproducer111", after: "zproducer111", active: true},
+		{schedule: []string{"nproducer111", testBp, "aproducer111"}, before: "nproducer111", after: "aproducer111", active: true},
+		{schedule: []string{testBp}, before: testBp, after: testBp, active: true},
+		{schedule: []string{"aproducer111", "zproducer111"}},
+	} {
+		m := newMockNodeos(testBp, tc.schedule...)
+		n := &neighbor{}
+		active, err := isTop21(n, m.api(), testBp)
+		m.Close()
+		before, after := n.get()
+		switch {
+		case err != nil:
+			t.Error(err)
+		case active != tc.active || before != tc.before || after != tc.after:
+			t.Errorf("%v: expected %v %s %s, got %v %s %s", tc.schedule, tc.active, tc.before, tc.after, active, before, after)
+		}
+	}
+
+	m := newMockNodeos(testBp, testBp)
+	defer m.Close()
+	m.set(func(m *mockNodeos) { m.failing["/v1/chain/get_producer_schedule"] = true })
+	if _, err := isTop21(&neighbor{}, m.api(), testBp); err == nil {
+		t.Error("expected an error from the schedule")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exported in the prometheus text format. There are few enough of them that pulling in the client
+// library isn't worth it.
+type metrics struct {
+	mux sync.Mutex
+
+	account      string
+	head         *chainHead
+	paused       bool
+	active       bool
+	maintenance  bool
+	lastProduced int64 // distance in blocks from head, -1 if unknown
+	lastHealthy  map[string]time.Time
+	triggers     map[[2]string]uint64 // detector, event kind
+	apiFailures  map[string]uint64    // producer api call
+	logSources   map[string]*logHealth
+	forkErrors   map[int]uint64 // fork watcher endpoint, by position in -fork-endpoints
+	forkDegraded bool
+}
+
+type logHealth struct {
+	connected bool
+	last      time.Time
+	lines     uint64
+	errors    uint64
+}
+
+var stats = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		head:         &chainHead{},
+		lastProduced: -1,
+		lastHealthy:  make(map[string]time.Time),
+		triggers:     make(map[[2]string]uint64),
+		apiFailures:  make(map[string]uint64),
+		logSources:   make(map[string]*logHealth),
+		forkErrors:   make(map[int]uint64),
+	}
+}
+
+func (m *metrics) setState(paused, active, maintenance bool) {
+	m.mux.Lock()
+	m.paused, m.active, m.maintenance = paused, active, maintenance
+	m.mux.Unlock()
+}
+
+func (m *metrics) heartbeat(routine string, t time.Time) {
+	m.mux.Lock()
+	m.lastHealthy[routine] = t
+	m.mux.Unlock()
+}
+
+func (m *metrics) trigger(ev event) {
+	m.mux.Lock()
+	m.triggers[[2]string{ev.Source, ev.Kind.String()}] += 1
+	m.mux.Unlock()
+}
+
+// apiFailure counts failed calls to the producer api.
+func (m *metrics) apiFailure(call string) {
+	m.mux.Lock()
+	m.apiFailures[call] += 1
+	m.mux.Unlock()
+}
+
+func (m *metrics) logHealth(source string) *logHealth {
+	if m.logSources[source] == nil {
+		m.logSources[source] = &logHealth{}
+	}
+	return m.logSources[source]
+}
+
+// logLine counts lines read from a log source, receiving a line means it is connected.
+func (m *metrics) logLine(source string) {
+	m.mux.Lock()
+	h := m.logHealth(source)
+	h.connected, h.last, h.lines = true, time.Now(), h.lines+1
+	m.mux.Unlock()
+}
+
+// logError counts log source failures, it is disconnected until the next line arrives.
+func (m *metrics) logError(source string) {
+	m.mux.Lock()
+	h := m.logHealth(source)
+	h.connected, h.errors = false, h.errors+1
+	m.mux.Unlock()
+}
+
+// forkPeerError counts failed requests to a fork watcher endpoint, numbered from 1.
+func (m *metrics) forkPeerError(endpoint int) {
+	m.mux.Lock()
+	m.forkErrors[endpoint] += 1
+	m.mux.Unlock()
+}
+
+// setForkDegraded is true when none of the fork watcher's endpoints are answering.
+func (m *metrics) setForkDegraded(degraded bool) {
+	m.mux.Lock()
+	m.forkDegraded = degraded
+	m.mux.Unlock()
+}
+
+// watchLastProduced tracks how long ago our producer signed a block, using the reversible block header state.
+func (m *metrics) watchLastProduced(w *watch) {
+	t := time.NewTicker(12 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+		block := w.head.get()
+		if block.BlockNum == 0 {
+			continue
+		}
+		distance, _ := lastProduced(w.api, w.account, block.BlockNum)
+		m.mux.Lock()
+		m.lastProduced = distance
+		m.mux.Unlock()
+	}
+}
+
+func (m *metrics) write(out io.Writer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	acc := `account="` + m.account + `"`
+	gauge := func(name, help string, values map[string]float64) {
+		_, _ = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(out, "%s{%s} %g\n", name, k, values[k])
+		}
+	}
+	counter := func(name, help string, values map[string]uint64) {
+		_, _ = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(out, "%s{%s} %d\n", name, k, values[k])
+		}
+	}
+	boolean := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	head := m.head.get()
+	var lag float64
+	if !head.BlockHeadTime.IsZero() {
+		lag = time.Since(head.BlockHeadTime).Seconds()
+	}
+	gauge("fio_standby_paused", "1 if block production is paused on this node", map[string]float64{acc: boolean(m.paused)})
+	gauge("fio_standby_active", "1 if the producer is in the active schedule", map[string]float64{acc: boolean(m.active)})
+	gauge("fio_standby_maintenance", "1 if automatic failover is suppressed", map[string]float64{acc: boolean(m.maintenance)})
+	gauge("fio_standby_head_block", "head block number", map[string]float64{acc: float64(head.BlockNum)})
+	gauge("fio_standby_head_lag_seconds", "seconds between now and the head block time", map[string]float64{acc: lag})
+	gauge("fio_standby_schedule_version", "producer schedule version of the head block", map[string]float64{acc: float64(head.ScheduleVersion)})
+	gauge("fio_standby_last_produced_distance_blocks", "blocks since the producer last signed a block, -1 if unknown", map[string]float64{acc: float64(m.lastProduced)})
+
+	hb := make(map[string]float64)
+	for routine, t := range m.lastHealthy {
+		hb[acc+`,routine="`+escapeLabel(routine)+`"`] = time.Since(t).Seconds()
+	}
+	gauge("fio_standby_heartbeat_age_seconds", "seconds since each routine sent a heartbeat", hb)
+
+	trig := make(map[string]uint64)
+	for k, v := range m.triggers {
+		trig[acc+`,detector="`+escapeLabel(k[0])+`",event="`+k[1]+`"`] = v
+	}
+	counter("fio_standby_detector_triggers_total", "number of missing or restored events sent by each detector", trig)
+
+	fails := make(map[string]uint64)
+	for k, v := range m.apiFailures {
+		fails[acc+`,call="`+escapeLabel(k)+`"`] = v
+	}
+	counter("fio_standby_producer_api_failures_total", "failed calls to the producer api", fails)
+
+	connected, age, lines, errs := make(map[string]float64), make(map[string]float64), make(map[string]uint64), make(map[string]uint64)
+	for k, h := range m.logSources {
+		l := acc + `,source="` + escapeLabel(k) + `"`
+		connected[l], lines[l], errs[l] = boolean(h.connected), h.lines, h.errors
+		if !h.last.IsZero() {
+			age[l] = time.Since(h.last).Seconds()
+		}
+	}
+	gauge("fio_standby_log_source_connected", "1 if lines are being read from the nodeos log source", connected)
+	gauge("fio_standby_log_last_line_age_seconds", "seconds since the last line was read from the nodeos log", age)
+	counter("fio_standby_log_lines_total", "lines read from the nodeos log", lines)
+	counter("fio_standby_log_source_errors_total", "failures reading the nodeos log, each is followed by a reconnect", errs)
+
+	gauge("fio_standby_fork_degraded", "1 if none of the fork watcher's endpoints are answering", map[string]float64{acc: boolean(m.forkDegraded)})
+	forkErrs := make(map[string]uint64)
+	for k, v := range m.forkErrors {
+		forkErrs[acc+`,endpoint="`+fmt.Sprint(k)+`"`] = v
+	}
+	counter("fio_standby_fork_endpoint_errors_total", "failed requests to the fork watcher's endpoints, by position in -fork-endpoints", forkErrs)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", stats)
+	log.Println("serving metrics on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.account = testBp
+	m.head.set(blockNumProd{BlockNum: 1234, BlockHeadTime: time.Now(), ScheduleVersion: 7})
+	m.setState(true, true, false)
+	m.heartbeat("missed blocks", time.Now())
+	m.trigger(event{Kind: eventMissing, Source: "missed blocks"})
+	m.trigger(event{Kind: eventMissing, Source: "missed blocks"})
+	m.apiFailure("resume")
+
+	buf := bytes.NewBuffer(nil)
+	m.write(buf)
+	out := buf.String()
+	for _, want := range []string{
+		`fio_standby_paused{account="producer1111"} 1`,
+		`fio_standby_maintenance{account="producer1111"} 0`,
+		`fio_standby_head_block{account="producer1111"} 1234`,
+		`fio_standby_schedule_version{account="producer1111"} 7`,
+		`fio_standby_last_produced_distance_blocks{account="producer1111"} -1`,
+		`fio_standby_heartbeat_age_seconds{account="producer1111",routine="missed blocks"}`,
+		`fio_standby_detector_triggers_total{account="producer1111",detector="missed blocks",event="missing"} 2`,
+		`fio_standby_producer_api_failures_total{account="producer1111",call="resume"} 1`,
+		"# TYPE fio_standby_detector_triggers_total counter",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+}
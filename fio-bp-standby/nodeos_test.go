@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mockNodeos is an in-process nodeos with the chain and producer apis the standby uses. A block is made for every
+// slot since starting, following the schedule. Producers that are down leave their slots empty, so the head stalls
+// the same way it does on a real chain. The account's slots are signed by the primary while it's up, and by the
+// standby (this node) while its producer api isn't paused.
+type mockNodeos struct {
+	*httptest.Server
+
+	mux       sync.Mutex
+	account   string
+	schedule  []string // in production order
+	version   uint32
+	perTurn   int // blocks in each producer's turn
+	slot      time.Duration
+	start     time.Time
+	slots     int // slots that have been looked at
+	down      map[string]bool
+	primaryUp bool
+	paused    bool            // the standby's producer api
+	failing   map[string]bool // paths that return a 500
+	calls     map[string]int
+	alerts    []alert // received by the webhook notifier at /alerts
+
+	blocks       []mockBlock // blocks[0] is block 1
+	lastProduced map[string]uint32
+	doubleSigned int // slots the primary and standby both signed
+}
+
+type mockBlock struct {
+	producer string
+	time     time.Time
+	version  uint32
+	standby  bool // signed by the standby
+}
+
+// newMockNodeos starts a chain at the beginning of the turn of the first producer in the schedule, with the
+// primary producing and the standby paused.
+func newMockNodeos(account string, schedule ...string) *mockNodeos {
+	m := &mockNodeos{
+		account:      account,
+		version:      1,
+		perTurn:      12,
+		slot:         500 * time.Millisecond,
+		start:        time.Now(),
+		down:         make(map[string]bool),
+		primaryUp:    true,
+		paused:       true,
+		failing:      make(map[string]bool),
+		calls:        make(map[string]int),
+		lastProduced: make(map[string]uint32),
+	}
+	m.schedule = append(m.schedule, schedule...)
+	sort.Strings(m.schedule)
+	mux := http.NewServeMux()
+	handle := func(path string, f func(body map[string]interface{}) interface{}) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			req := make(map[string]interface{})
+			b, _ := ioutil.ReadAll(r.Body)
+			_ = json.Unmarshal(b, &req)
+			m.mux.Lock()
+			defer m.mux.Unlock()
+			m.calls[path] += 1
+			if m.failing[path] {
+				http.Error(w, "mock failure", http.StatusInternalServerError)
+				return
+			}
+			m.advance(time.Now())
+			resp := f(req)
+			if err, ok := resp.(error); ok {
+				w.WriteHeader(http.StatusBadRequest)
+				resp = map[string]interface{}{"code": 400, "message": err.Error()}
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		})
+	}
+	handle("/v1/chain/get_info", m.info)
+	handle("/v1/chain/get_block", m.block)
+	handle("/v1/chain/get_block_header_state", m.blockHeaderState)
+	handle("/v1/chain/get_producer_schedule", func(map[string]interface{}) interface{} {
+		return map[string]interface{}{"active": m.activeSchedule(), "pending": nil, "proposed": nil}
+	})
+	handle("/v1/producer/paused", func(map[string]interface{}) interface{} {
+		return m.paused
+	})
+	handle("/v1/producer/pause", func(map[string]interface{}) interface{} {
+		m.paused = true
+		return map[string]string{"result": "ok"}
+	})
+	handle("/v1/producer/resume", func(map[string]interface{}) interface{} {
+		m.paused = false
+		return map[string]string{"result": "ok"}
+	})
+	mux.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+		a := alert{}
+		_ = json.NewDecoder(r.Body).Decode(&a)
+		m.mux.Lock()
+		m.alerts = append(m.alerts, a)
+		m.mux.Unlock()
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockNodeos) api() *fio.API {
+	return &fio.API{API: eos.New(m.URL)}
+}
+
+// advance makes the blocks for every slot up to now
+func (m *mockNodeos) advance(now time.Time) {
+	for ; m.start.Add(time.Duration(m.slots) * m.slot).Before(now); m.slots++ {
+		producer := m.schedule[(m.slots/m.perTurn)%len(m.schedule)]
+		b := mockBlock{producer: producer, time: m.start.Add(time.Duration(m.slots) * m.slot), version: m.version}
+		switch {
+		case producer == m.account && m.primaryUp && !m.paused:
+			m.doubleSigned += 1
+		case producer == m.account && !m.primaryUp && !m.paused:
+			b.standby = true
+		case producer == m.account && !m.primaryUp, m.down[producer]:
+			continue
+		}
+		m.blocks = append(m.blocks, b)
+		m.lastProduced[producer] = uint32(len(m.blocks))
+	}
+}
+
+func (m *mockNodeos) head() (uint32, mockBlock) {
+	if len(m.blocks) == 0 {
+		return 0, mockBlock{time: m.start}
+	}
+	return uint32(len(m.blocks)), m.blocks[len(m.blocks)-1]
+}
+
+func (m *mockNodeos) info(map[string]interface{}) interface{} {
+	num, b := m.head()
+	lib := uint32(0)
+	if num > 12 {
+		lib = num - 12
+	}
+	return map[string]interface{}{
+		"server_version":              "mock",
+		"chain_id":                    fio.ChainIdTestnet,
+		"head_block_num":              num,
+		"last_irreversible_block_num": lib,
+		"head_block_time":             eos.JSONTime{Time: b.time.UTC()},
+		"head_block_producer":         b.producer,
+	}
+}
+
+func (m *mockNodeos) block(req map[string]interface{}) interface{} {
+	num, err := strconv.ParseUint(fmt.Sprint(req["block_num_or_id"]), 10, 32)
+	if err != nil || num == 0 || int(num) > len(m.blocks) {
+		return fmt.Errorf("could not find block: %v", req["block_num_or_id"])
+	}
+	b := m.blocks[num-1]
+	return map[string]interface{}{
+		"block_num":        num,
+		"timestamp":        eos.BlockTimestamp{Time: b.time.UTC()},
+		"producer":         b.producer,
+		"schedule_version": b.version,
+		"transactions":     []interface{}{},
+	}
+}
+
+func (m *mockNodeos) blockHeaderState(map[string]interface{}) interface{} {
+	num, _ := m.head()
+	lp := make([]interface{}, 0)
+	for _, p := range m.schedule {
+		if n, ok := m.lastProduced[p]; ok {
+			lp = append(lp, []interface{}{p, n})
+		}
+	}
+	return map[string]interface{}{
+		"block_num":                 num,
+		"active_schedule":           m.activeSchedule(),
+		"producer_to_last_produced": lp,
+	}
+}
+
+func (m *mockNodeos) activeSchedule() map[string]interface{} {
+	prods := make([]map[string]string, len(m.schedule))
+	for i := range m.schedule {
+		prods[i] = map[string]string{"producer_name": m.schedule[i]}
+	}
+	return map[string]interface{}{"version": m.version, "producers": prods}
+}
+
+// set runs f while holding the lock, for changing the scenario
+func (m *mockNodeos) set(f func(m *mockNodeos)) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.advance(time.Now())
+	f(m)
+}
+
+func (m *mockNodeos) called(path string) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.calls[path]
+}
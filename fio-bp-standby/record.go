@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A recording is a json-lines file of frames, each holding one observation. It captures everything the detectors
+// look at so an incident can be replayed later to see exactly what the standby would have done.
+
+type frame struct {
+	Time        time.Time            `json:"time"`
+	Head        *blockNumProd        `json:"head,omitempty"`
+	Schedule    *recordedSchedule    `json:"schedule,omitempty"`
+	HeaderState *recordedHeaderState `json:"header_state,omitempty"`
+	Block       *recordedBlock       `json:"block,omitempty"`
+	Log         *string              `json:"log,omitempty"`
+}
+
+type recordedSchedule struct {
+	Version   uint32   `json:"version"`
+	Producers []string `json:"producers"`
+}
+
+// recordedHeaderState is the part of get_block_header_state used by the detectors.
+type recordedHeaderState struct {
+	BlockNum       uint32            `json:"block_num"`
+	HasPending     bool              `json:"has_pending_schedule"`
+	ScheduleLibNum uint32            `json:"schedule_lib_num"`
+	LastProduced   map[string]uint32 `json:"last_produced"`
+	Active         *recordedSchedule `json:"active_schedule,omitempty"`
+	Pending        *recordedSchedule `json:"pending_schedule,omitempty"`
+}
+
+func newRecordedSchedule(s *fio.Schedule) *recordedSchedule {
+	if s == nil || len(s.Producers) == 0 {
+		return nil
+	}
+	r := &recordedSchedule{Version: s.Version, Producers: make([]string, len(s.Producers))}
+	for i := range s.Producers {
+		r.Producers[i] = string(s.Producers[i].AccountName)
+	}
+	return r
+}
+
+func (r *recordedSchedule) schedule() *fio.Schedule {
+	if r == nil {
+		return nil
+	}
+	s := &fio.Schedule{Version: r.Version, Producers: make([]fio.ProducerKey, len(r.Producers))}
+	for i := range r.Producers {
+		s.Producers[i].AccountName = eos.AccountName(r.Producers[i])
+	}
+	return s
+}
+
+func newRecordedHeaderState(bhs *fio.BlockHeaderState) *recordedHeaderState {
+	r := &recordedHeaderState{BlockNum: bhs.BlockNum, LastProduced: make(map[string]uint32)}
+	r.Active = newRecordedSchedule(bhs.ActiveSchedule)
+	if bhs.PendingSchedule != nil {
+		r.HasPending = true
+		r.ScheduleLibNum = bhs.PendingSchedule.ScheduleLibNum
+		r.Pending = newRecordedSchedule(bhs.PendingSchedule.Schedule)
+	}
+	if ok, lp := bhs.ProducerToLast(fio.ProducerToLastProduced); ok {
+		for _, prod := range lp {
+			r.LastProduced[string(prod.Producer)] = prod.BlockNum
+		}
+	}
+	return r
+}
+
+// headerState rebuilds enough of a BlockHeaderState for the detectors
+func (r *recordedHeaderState) headerState() *fio.BlockHeaderState {
+	bhs := &fio.BlockHeaderState{BlockNum: r.BlockNum, ActiveSchedule: r.Active.schedule()}
+	if r.HasPending {
+		bhs.PendingSchedule = &fio.PendingSchedule{ScheduleLibNum: r.ScheduleLibNum, Schedule: r.Pending.schedule()}
+	}
+	for prod, num := range r.LastProduced {
+		if j, err := json.Marshal([]interface{}{prod, num}); err == nil {
+			bhs.ProducerToLastProduced = append(bhs.ProducerToLastProduced, j)
+		}
+	}
+	return bhs
+}
+
+type recordedBlock struct {
+	BlockNum        uint32    `json:"block_num"`
+	Producer        string    `json:"producer"`
+	Timestamp       time.Time `json:"timestamp"`
+	ScheduleVersion uint32    `json:"schedule_version"`
+}
+
+func (r *recordedBlock) blockResp() *eos.BlockResp {
+	b := &eos.BlockResp{BlockNum: r.BlockNum}
+	b.Producer = eos.AccountName(r.Producer)
+	b.Timestamp = eos.BlockTimestamp{Time: r.Timestamp}
+	b.ScheduleVersion = r.ScheduleVersion
+	return b
+}
+
+type recorder struct {
+	mux sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// newRecorder appends to a recording, creating it if needed.
+func newRecorder(file string) (*recorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) write(fr frame) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if fr.Time.IsZero() {
+		fr.Time = time.Now().UTC()
+	}
+	return r.enc.Encode(fr)
+}
+
+// run records the shared head block as it changes, the schedule every minute, the header state at the same
+// interval the round detector uses, and every line from the nodeos log.
+func (r *recorder) run(w *watch, api *fio.API, events chan<- event, failed chan<- error) {
+	const name = "recorder"
+	if w.logs != nil {
+		go r.lines(w.logs.subscribe(failed, w.stop), failed, w.stop)
+	}
+
+	var lastHead, lastLib uint32
+	var i int
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+		i += 1
+		if !w.send(events, event{Kind: eventHeartbeat, Source: name}) {
+			return
+		}
+		head := w.head.get()
+		if head.BlockNum == 0 {
+			continue
+		}
+		if head.BlockNum != lastHead {
+			if err := r.write(frame{Head: &head}); err != nil && !w.fail(failed, err) {
+				return
+			}
+			lastHead = head.BlockNum
+		}
+		if i%60 == 1 {
+			ps, err := api.GetProducerSchedule()
+			if err != nil {
+				if !w.fail(failed, err) {
+					return
+				}
+				continue
+			}
+			sched := &recordedSchedule{Version: ps.Active.Version, Producers: make([]string, 0)}
+			for _, p := range ps.Active.Producers {
+				sched.Producers = append(sched.Producers, string(p.AccountName))
+			}
+			if err = r.write(frame{Schedule: sched}); err != nil && !w.fail(failed, err) {
+				return
+			}
+		}
+		if i%6 != 0 {
+			continue
+		}
+		bhs, err := api.GetBlockHeaderState(head.BlockNum)
+		if err != nil {
+			if !w.fail(failed, err) {
+				return
+			}
+			continue
+		}
+		rhs := newRecordedHeaderState(bhs)
+		if err = r.write(frame{HeaderState: rhs}); err != nil && !w.fail(failed, err) {
+			return
+		}
+		// the round detector looks up when the schedule became active
+		if rhs.HasPending && rhs.ScheduleLibNum != lastLib {
+			b, err := api.GetBlockByNum(rhs.ScheduleLibNum)
+			if err != nil {
+				if !w.fail(failed, err) {
+					return
+				}
+				continue
+			}
+			err = r.write(frame{Block: &recordedBlock{
+				BlockNum:        b.BlockNum,
+				Producer:        string(b.Producer),
+				Timestamp:       b.Timestamp.Time,
+				ScheduleVersion: b.ScheduleVersion,
+			}})
+			if err != nil {
+				if !w.fail(failed, err) {
+					return
+				}
+				continue
+			}
+			lastLib = rhs.ScheduleLibNum
+		}
+	}
+}
+
+func (r *recorder) lines(lines <-chan logLine, failed chan<- error, stop <-chan struct{}) {
+	for {
+		var line logLine
+		select {
+		case line = <-lines:
+		case <-stop:
+			return
+		}
+		text := line.Text
+		if err := r.write(frame{Time: line.Time.UTC(), Log: &text}); err != nil {
+			select {
+			case failed <- err:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func loadRecording(file string) ([]frame, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frames := make([]frame, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var n int
+	for scanner.Scan() {
+		n += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		fr := frame{}
+		if err = json.Unmarshal(scanner.Bytes(), &fr); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, n, err)
+		}
+		frames = append(frames, fr)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, errors.New(file + " is empty")
+	}
+	return frames, nil
+}
+
+// recordedChain answers the detectors' api calls from a recording.
+type recordedChain struct {
+	bhs    *recordedHeaderState
+	blocks map[uint32]*recordedBlock
+}
+
+func (rc *recordedChain) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+	if rc.blocks[num] == nil {
+		return nil, fmt.Errorf("block %d is not in the recording", num)
+	}
+	return rc.blocks[num].blockResp(), nil
+}
+
+func (rc *recordedChain) GetBlockHeaderState(numOrId interface{}) (*fio.BlockHeaderState, error) {
+	if rc.bhs == nil {
+		return nil, errors.New("no block header state has been recorded yet")
+	}
+	return rc.bhs.headerState(), nil
+}
+
+// decision is something the standby would have done during a replay.
+type decision struct {
+	Time   time.Time `json:"time"`
+	Block  uint32    `json:"block"`
+	Action string    `json:"action"`
+	Source string    `json:"source"`
+	Reason string    `json:"reason"`
+}
+
+func (d decision) String() string {
+	return fmt.Sprintf("%s  block %-10d %-7s %s: %s", d.Time.UTC().Format("2006-01-02T15:04:05.000"), d.Block, d.Action, d.Source, d.Reason)
+}
+
+// replay feeds a recording to the detectors using a virtual clock, and reports when production would have been
+// resumed or paused. It follows the same rules as the main loop: start paused, only resume if in the schedule and
+// synced, only pause if producing. It doesn't account for the lease, or the control API. A nil limits uses the
+// default thresholds.
+func replay(frames []frame, account eos.AccountName, detect []Detector, limits *tuning) ([]decision, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("empty recording")
+	}
+	var (
+		now       = frames[0].Time
+		paused    = true
+		active    bool
+		decisions = make([]decision, 0)
+		rc        = &recordedChain{blocks: make(map[uint32]*recordedBlock)}
+	)
+	w := &watch{
+		account:   account,
+		api:       rc,
+		head:      &chainHead{},
+		neighbors: &neighbor{},
+		isPaused:  func() bool { return paused },
+		limits:    limits,
+	}
+
+	steppers := make([]stepper, 0)
+	next := make([]time.Time, 0)
+	watchers := make([]lineWatcher, 0)
+	for _, d := range detect {
+		replayable := false
+		if s, ok := d.(stepper); ok {
+			steppers = append(steppers, s)
+			next = append(next, now.Add(s.Interval()))
+			replayable = true
+		}
+		if l, ok := d.(lineWatcher); ok {
+			watchers = append(watchers, l)
+			replayable = true
+		}
+		if !replayable {
+			log.Printf("detector %s can't be replayed, skipping", d.Name())
+		}
+	}
+
+	handle := func(evs []event) {
+		for _, ev := range evs {
+			head := w.head.get()
+			switch {
+			case ev.Kind == eventMissing && paused && inSchedule(w.neighbors, head, active) && !head.syncingAt(now):
+				paused = false
+				decisions = append(decisions, decision{Time: now, Block: head.BlockNum, Action: "resume", Source: ev.Source, Reason: ev.Reason})
+			case ev.Kind == eventRestored && !paused:
+				paused = true
+				decisions = append(decisions, decision{Time: now, Block: head.BlockNum, Action: "pause", Source: ev.Source, Reason: ev.Reason})
+			}
+		}
+	}
+
+	end := frames[len(frames)-1].Time
+	i := 0
+	for {
+		// find the next detector step, frames at the same time are applied first
+		s := -1
+		for j := range steppers {
+			if s == -1 || next[j].Before(next[s]) {
+				s = j
+			}
+		}
+		if i < len(frames) && (s == -1 || !frames[i].Time.After(next[s])) {
+			fr := frames[i]
+			i += 1
+			if fr.Time.After(now) {
+				now = fr.Time
+			}
+			switch {
+			case fr.Head != nil:
+				w.head.set(*fr.Head)
+			case fr.Schedule != nil:
+				var before, after string
+				before, after, active = sortedNeighbors(fr.Schedule.Producers, string(account))
+				if active {
+					w.neighbors.set(before, after)
+				}
+			case fr.HeaderState != nil:
+				rc.bhs = fr.HeaderState
+				w.neighbors.track(fr.HeaderState.headerState(), string(account))
+			case fr.Block != nil:
+				rc.blocks[fr.Block.BlockNum] = fr.Block
+			case fr.Log != nil:
+				for _, l := range watchers {
+					handle(l.Line(w, *fr.Log))
+				}
+			}
+			continue
+		}
+		if s == -1 || next[s].After(end) {
+			break
+		}
+		now = next[s]
+		next[s] = now.Add(steppers[s].Interval())
+		evs, err := steppers[s].Step(w, now)
+		if err != nil {
+			log.Printf("%s: %v", steppers[s].Name(), err)
+		}
+		handle(evs)
+	}
+	return decisions, nil
+}
+
+// runReplay is the -replay command, it prints the decisions and returns the exit code.
+func runReplay(file string, account eos.AccountName, detect []Detector, limits *tuning) int {
+	frames, err := loadRecording(file)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("replaying %d frames from %s to %s", len(frames), frames[0].Time.UTC().Format(time.RFC3339), frames[len(frames)-1].Time.UTC().Format(time.RFC3339))
+	decisions, err := replay(frames, account, detect, limits)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if len(decisions) == 0 {
+		fmt.Println("no production changes")
+	}
+	for _, d := range decisions {
+		fmt.Println(d)
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the .expected files for recordings in testdata")
+
+// replayDetectors returns fresh detectors with their default intervals
+func replayDetectors(t *testing.T) []Detector {
+	d, err := newDetectors("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// TestReplayRecordings replays every recording in testdata, comparing the decisions against the .expected file
+// alongside it. Add a recording from an incident with its account in the name, ex: 'my-incident.bp1kaaaaaaaa.jsonl'
+// and run 'go test -run TestReplayRecordings -update', then review the .expected file.
+func TestReplayRecordings(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no recordings in testdata")
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			parts := strings.Split(filepath.Base(file), ".")
+			if len(parts) != 3 || len(parts[1]) != 12 {
+				t.Fatal("recording should be named <description>.<account>.jsonl")
+			}
+			frames, err := loadRecording(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decisions, err := replay(frames, eos.AccountName(parts[1]), replayDetectors(t), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, d := range decisions {
+				got = append(got, d.String())
+			}
+			expectedFile := strings.TrimSuffix(file, ".jsonl") + ".expected"
+			if *update {
+				if err = ioutil.WriteFile(expectedFile, []byte(strings.Join(got, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			b, err := ioutil.ReadFile(expectedFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.TrimSpace(string(b)); want != strings.TrimSpace(strings.Join(got, "\n")) {
+				t.Errorf("decisions differ\nexpected:\n%s\ngot:\n%s", want, strings.Join(got, "\n"))
+			}
+		})
+	}
+}
+
+func TestReplayMissedRound(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	frames, err := loadRecording("testdata/missed-round.bp1kaaaaaaaa.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions, err := replay(frames, "bp1kaaaaaaaa", replayDetectors(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 2 {
+		t.Fatalf("expected resume and pause, got %v", decisions)
+	}
+	// the producer before us finished at 00:00:59.5, four missed blocks later we should resume
+	if decisions[0].Action != "resume" || decisions[0].Source != "missed blocks" ||
+		decisions[0].Time.Sub(frames[0].Time) > 65*time.Second {
+		t.Error("did not resume quickly enough for a missed round", decisions[0])
+	}
+	if decisions[1].Action != "pause" || decisions[1].Source != "log watcher" {
+		t.Error("should pause after the primary produced a duplicate block", decisions[1])
+	}
+}
+
+func TestReplayTwoDown(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	frames, err := loadRecording("testdata/two-down.bp1kaaaaaaaa.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the neighbor before us is also down, so only the round detector can find it
+	only := func(name string) []Detector {
+		d, err := newDetectors(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	decisions, err := replay(frames, "bp1kaaaaaaaa", only("order"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 0 {
+		t.Error("order detector should not see missed blocks when the previous producer is down", decisions)
+	}
+	decisions, err = replay(frames, "bp1kaaaaaaaa", only("order,round"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Action != "resume" || decisions[0].Source != "missed rounds" {
+		t.Fatal("round detector should resume production", decisions)
+	}
+}
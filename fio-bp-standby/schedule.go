@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/fioprotocol/fio-go"
+	"log"
+	"time"
+)
+
+// When the schedule changes the neighbors change with it. The new schedule is pending for a few minutes before it
+// is activated, so the neighbors for both the active and pending schedules are worked out ahead of time. Every block
+// includes the version of the schedule that produced it, which is used to pick the right set of neighbors on exactly
+// the block where the new schedule takes over.
+
+// scheduleNeighbors are the neighbors for a single schedule version
+type scheduleNeighbors struct {
+	Before    string
+	After     string
+	Scheduled bool // false if the account isn't in this schedule
+}
+
+// track records the neighbors for the active and pending schedules in a block header state, older versions are
+// dropped. It returns the versions that were new.
+func (n *neighbor) track(bhs *fio.BlockHeaderState, account string) []uint32 {
+	schedules := make([]*fio.Schedule, 0, 2)
+	if bhs.ActiveSchedule != nil && len(bhs.ActiveSchedule.Producers) > 0 {
+		schedules = append(schedules, bhs.ActiveSchedule)
+	}
+	if bhs.PendingSchedule != nil && bhs.PendingSchedule.Schedule != nil && len(bhs.PendingSchedule.Schedule.Producers) > 0 &&
+		(len(schedules) == 0 || bhs.PendingSchedule.Schedule.Version > schedules[0].Version) {
+		schedules = append(schedules, bhs.PendingSchedule.Schedule)
+	}
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.versions == nil {
+		n.versions = make(map[uint32]scheduleNeighbors)
+	}
+	for v := range n.versions {
+		if v < schedules[0].Version {
+			delete(n.versions, v)
+		}
+	}
+	added := make([]uint32, 0)
+	for _, s := range schedules {
+		if _, ok := n.versions[s.Version]; ok {
+			continue
+		}
+		prods := make([]string, len(s.Producers))
+		for i := range s.Producers {
+			prods[i] = string(s.Producers[i].AccountName)
+		}
+		sn := scheduleNeighbors{}
+		sn.Before, sn.After, sn.Scheduled = sortedNeighbors(prods, account)
+		n.versions[s.Version] = sn
+		added = append(added, s.Version)
+	}
+	return added
+}
+
+// at returns the neighbors for the schedule version that produced a block. If the version isn't known it falls back
+// to the neighbors in the active schedule from isTop21.
+func (n *neighbor) at(version uint32) (before string, after string, scheduled bool) {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	if sn, ok := n.versions[version]; ok {
+		return sn.Before, sn.After, sn.Scheduled
+	}
+	return n.Before, n.After, n.Before != ""
+}
+
+// scheduled reports if the account is in a schedule version, known is false if the version isn't being tracked.
+func (n *neighbor) scheduled(version uint32) (scheduled bool, known bool) {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	sn, known := n.versions[version]
+	return sn.Scheduled, known
+}
+
+// trackSchedules follows the schedules in the head block's header state. It isn't a Detector, but it does send
+// heartbeats so the main loop knows it is running.
+func trackSchedules(w *watch, api chainReader, events chan<- event, failed chan<- error) {
+	const name = "schedule tracker"
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+		head := w.head.get()
+		if head.BlockNum == 0 {
+			continue
+		}
+		bhs, err := api.GetBlockHeaderState(head.BlockNum)
+		if err != nil {
+			if !w.fail(failed, err) {
+				return
+			}
+			continue
+		}
+		for _, v := range w.neighbors.track(bhs, string(w.account)) {
+			logSchedule(w, v, head.ScheduleVersion)
+		}
+		if !w.send(events, event{Kind: eventHeartbeat, Source: name}) {
+			return
+		}
+	}
+}
+
+func logSchedule(w *watch, version uint32, current uint32) {
+	before, after, scheduled := w.neighbors.at(version)
+	state := "active"
+	if version > current {
+		state = "pending"
+	}
+	switch {
+	case scheduled:
+		log.Printf("%s schedule version %d: %s is between %s and %s", state, version, w.account, before, after)
+	default:
+		log.Printf("%s schedule version %d: %s is not scheduled", state, version, w.account)
+	}
+}
+
+// inSchedule reports if the account is scheduled to produce at head. It uses the tracked schedule that produced the
+// head block, and only falls back to active (from the once a minute check of the active schedule) if that
+// schedule isn't known.
+func inSchedule(n *neighbor, head blockNumProd, active bool) bool {
+	if scheduled, known := n.scheduled(head.ScheduleVersion); known {
+		return scheduled
+	}
+	return active
+}
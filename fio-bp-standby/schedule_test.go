@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func testSchedule(version uint32, prods ...string) *fio.Schedule {
+	s := &fio.Schedule{Version: version}
+	for _, p := range prods {
+		s.Producers = append(s.Producers, fio.ProducerKey{AccountName: eos.AccountName(p)})
+	}
+	return s
+}
+
+func TestNeighborTrack(t *testing.T) {
+	n := &neighbor{}
+	n.set("aproducer111", "zproducer111")
+	bhs := &fio.BlockHeaderState{
+		ActiveSchedule: testSchedule(5, "aproducer111", testBp, "zproducer111"),
+		PendingSchedule: &fio.PendingSchedule{
+			Schedule: testSchedule(6, "aproducer111", "mproducer111", testBp, "zproducer111"),
+		},
+	}
+	if added := n.track(bhs, testBp); len(added) != 2 {
+		t.Fatal("expected active and pending schedules to be added", added)
+	}
+	if added := n.track(bhs, testBp); len(added) != 0 {
+		t.Error("schedules should only be added once", added)
+	}
+	if before, after, ok := n.at(5); before != "aproducer111" || after != "zproducer111" || !ok {
+		t.Error("wrong neighbors for active schedule", before, after)
+	}
+	if before, _, ok := n.at(6); before != "mproducer111" || !ok {
+		t.Error("wrong neighbors for pending schedule", before)
+	}
+	// unknown version falls back to isTop21's neighbors
+	if before, _, ok := n.at(9); before != "aproducer111" || !ok {
+		t.Error("should fall back for unknown version", before)
+	}
+
+	// pending becomes active, next pending drops us
+	bhs.ActiveSchedule = bhs.PendingSchedule.Schedule
+	bhs.PendingSchedule.Schedule = testSchedule(7, "aproducer111", "mproducer111", "zproducer111")
+	n.track(bhs, testBp)
+	if _, known := n.scheduled(5); known {
+		t.Error("old schedule should be dropped")
+	}
+	if scheduled, known := n.scheduled(7); scheduled || !known {
+		t.Error("should not be scheduled in version 7")
+	}
+	if inSchedule(n, blockNumProd{ScheduleVersion: 7}, true) {
+		t.Error("tracked schedule should override active")
+	}
+	if !inSchedule(n, blockNumProd{ScheduleVersion: 9}, true) {
+		t.Error("unknown schedule should use active")
+	}
+
+	// an empty pending schedule, or the same version as active is ignored
+	n = &neighbor{}
+	n.track(&fio.BlockHeaderState{
+		ActiveSchedule:  testSchedule(5, testBp),
+		PendingSchedule: &fio.PendingSchedule{Schedule: testSchedule(5)},
+	}, testBp)
+	if len(n.versions) != 1 {
+		t.Error("expected only the active schedule", n.versions)
+	}
+}
+
+func TestOrderDetectorScheduleChange(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	w := testWatch(nil)
+	w.neighbors.track(&fio.BlockHeaderState{
+		ActiveSchedule: testSchedule(1, "aproducer111", testBp, "zproducer111"),
+		PendingSchedule: &fio.PendingSchedule{
+			Schedule: testSchedule(2, "aproducer111", "mproducer111", testBp, "zproducer111"),
+		},
+	}, testBp)
+	d := &orderDetector{interval: time.Second}
+	now := time.Now()
+
+	stall := func(b blockNumProd, steps int) bool {
+		b.BlockHeadTime = now
+		w.head.set(b)
+		for i := 0; i < steps; i++ {
+			now = now.Add(time.Second)
+			evs, _ := d.Step(w, now)
+			for _, ev := range evs {
+				if ev.Kind == eventMissing {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// on version 1 mproducer111 is not before us, a stall is someone else's problem
+	if stall(blockNumProd{Producer: "mproducer111", BlockNum: 100, ScheduleVersion: 1}, 6) {
+		t.Fatal("should not use the pending schedule before it is active")
+	}
+	// the block where version 2 takes over, now mproducer111 is before us
+	if !stall(blockNumProd{Producer: "mproducer111", BlockNum: 101, ScheduleVersion: 2}, 6) {
+		t.Fatal("should use the new neighbors as soon as the schedule is active")
+	}
+
+	// leaving the schedule
+	w.neighbors.track(&fio.BlockHeaderState{
+		ActiveSchedule: testSchedule(2, "aproducer111", "mproducer111", testBp, "zproducer111"),
+		PendingSchedule: &fio.PendingSchedule{
+			Schedule: testSchedule(3, "aproducer111", "mproducer111", "zproducer111"),
+		},
+	}, testBp)
+	if stall(blockNumProd{Producer: "mproducer111", BlockNum: 200, ScheduleVersion: 3}, 6) {
+		t.Fatal("should not be missing when not in the schedule")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go/eos"
+	"github.com/fioprotocol/fio-go/eos/ecc"
+	"os"
+	"strings"
+)
+
+// nodeos doesn't complain if its signature provider has a different key than the one registered on-chain, it
+// resumes and then never signs a block. Before resuming, the standby compares the keys its node is configured with
+// to the producer_public_key in the eosio producers table.
+
+// tableReader is the subset of *fio.API needed to read the producers table
+type tableReader interface {
+	GetTableRows(params eos.GetTableRowsRequest) (*eos.GetTableRowsResp, error)
+}
+
+// producerKey reads producer_public_key from the producers table, using the same query as fio-bp-vote.
+func producerKey(api tableReader, account eos.AccountName) (string, error) {
+	gtr, err := api.GetTableRows(eos.GetTableRowsRequest{
+		Code:       "eosio",
+		Scope:      "eosio",
+		Table:      "producers",
+		LowerBound: string(account),
+		UpperBound: string(account),
+		KeyType:    "name",
+		Index:      "4",
+		JSON:       true,
+	})
+	if err != nil {
+		return "", err
+	}
+	rows := make([]struct {
+		Owner             string `json:"owner"`
+		ProducerPublicKey string `json:"producer_public_key"`
+	}, 0)
+	if err = json.Unmarshal(gtr.Rows, &rows); err != nil {
+		return "", err
+	}
+	if len(rows) != 1 || rows[0].Owner != string(account) {
+		return "", fmt.Errorf("%s is not a registered producer", account)
+	}
+	return rows[0].ProducerPublicKey, nil
+}
+
+// signatureProviders reads the public keys from the signature-provider lines in a nodeos config.ini
+func signatureProviders(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "signature-provider" {
+			continue
+		}
+		// <public key>=<provider>:<data>, only the public key is kept
+		key := strings.TrimSpace(strings.SplitN(parts[1], "=", 2)[0])
+		if _, err = ecc.NewPublicKey(key); err != nil {
+			return nil, fmt.Errorf("%s: invalid signature-provider key: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signature-provider found", file)
+	}
+	return keys, nil
+}
+
+// signingCheck compares the local signing keys with the key that will be used on-chain once resumed. The nodeos
+// config is read on every check, so fixing it and restarting nodeos doesn't need a restart of the standby. A nil
+// signingCheck always passes.
+type signingCheck struct {
+	keys   []string // keys given on the command line
+	config string   // nodeos config.ini, optional
+	// expected returns the key that has to be in the local node. With the producer api it is the registered key,
+	// with key rotation it's the standby's key that resuming registers.
+	expected func() (string, error)
+}
+
+func newSigningCheck(keys []string, config string, expected func() (string, error)) (*signingCheck, error) {
+	if len(keys) == 0 && config == "" {
+		return nil, nil
+	}
+	for _, k := range keys {
+		if _, err := ecc.NewPublicKey(k); err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %w", k, err)
+		}
+	}
+	s := &signingCheck{keys: keys, config: config, expected: expected}
+	if _, err := s.local(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *signingCheck) local() ([]string, error) {
+	if s.config == "" {
+		return s.keys, nil
+	}
+	keys, err := signatureProviders(s.config)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, s.keys...), keys...), nil
+}
+
+// check returns an error unless one of the local keys matches
+func (s *signingCheck) check() error {
+	if s == nil {
+		return nil
+	}
+	local, err := s.local()
+	if err != nil {
+		return err
+	}
+	want, err := s.expected()
+	if err != nil {
+		return errors.New("could not get the on-chain signing key: " + err.Error())
+	}
+	for _, k := range local {
+		if sameKey(k, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signing key %s is not configured on the node, it has %s", want, strings.Join(local, ", "))
+}
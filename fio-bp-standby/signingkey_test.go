@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeProducers is a tableReader with a single row in the producers table
+type fakeProducers struct {
+	rows string
+	err  error
+}
+
+func (f *fakeProducers) GetTableRows(params eos.GetTableRowsRequest) (*eos.GetTableRowsResp, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &eos.GetTableRowsResp{Rows: []byte(f.rows)}, nil
+}
+
+func TestSigningCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registered, other := testKey(4), testKey(5)
+	chain := &fakeProducers{rows: `[{"owner":"` + testBp + `","producer_public_key":"` + registered + `"}]`}
+	if k, err := producerKey(chain, testBp); err != nil || k != registered {
+		t.Fatal("expected the registered key, got", k, err)
+	}
+	if _, err = producerKey(&fakeProducers{rows: `[]`}, testBp); err == nil {
+		t.Error("expected an error if not registered")
+	}
+
+	ini := filepath.Join(dir, "config.ini")
+	write := func(key string) {
+		body := "plugin = eosio::producer_api_plugin\n# signature-provider = " + registered + "=KEY:commented\n" +
+			"signature-provider = " + key + "=KEY:5Jxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx\n"
+		if err := ioutil.WriteFile(ini, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(other)
+	expected := func() (string, error) { return producerKey(chain, testBp) }
+	s, err := newSigningCheck(nil, ini, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.check(); err == nil || !strings.Contains(err.Error(), other) {
+		t.Error("expected a key mismatch, got", err)
+	}
+
+	// the config is read again on every check
+	write(registered)
+	if err = s.check(); err != nil {
+		t.Error(err)
+	}
+
+	// keys given on the command line are checked along with the config
+	s, err = newSigningCheck([]string{registered}, "", expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.check(); err != nil {
+		t.Error(err)
+	}
+	chain.err = errors.New("connection refused")
+	if err = s.check(); err == nil {
+		t.Error("should fail if the on-chain key can't be read")
+	}
+
+	if _, err = newSigningCheck([]string{"not a key"}, "", expected); err == nil {
+		t.Error("expected an invalid key to fail")
+	}
+	if _, err = newSigningCheck(nil, filepath.Join(dir, "missing.ini"), expected); err == nil {
+		t.Error("expected a missing config to fail")
+	}
+	var none *signingCheck
+	if none.check() != nil {
+		t.Error("nil signingCheck should always pass")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The state is saved so a restart doesn't undo a failover. Without it the standby always starts paused, and if it
+// is being restarted over and over by systemd while the primary is down, every restart stops production again.
+
+// standbyState is what is kept between restarts
+type standbyState struct {
+	Paused    bool        `json:"paused"`
+	Changed   time.Time   `json:"changed"`   // last time production was paused or resumed
+	Reason    string      `json:"reason"`    // why it was paused or resumed
+	Failovers int         `json:"failovers"` // times the standby has resumed production
+	Starts    []time.Time `json:"starts"`    // recent starts, for finding a crash loop
+}
+
+// stateStore saves the state to a json file after every change, without a path it is only kept in memory.
+type stateStore struct {
+	path  string
+	mux   sync.Mutex
+	state standbyState
+}
+
+// loadState reads the saved state, a missing file starts paused. If the file can't be read a usable store is still
+// returned along with the error, so a corrupt file doesn't keep the standby from starting.
+func loadState(path string) (*stateStore, error) {
+	s := &stateStore{path: path, state: standbyState{Paused: true}}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return s, err
+	case len(b) == 0:
+		return s, nil
+	}
+	saved := standbyState{}
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	s.state = saved
+	return s, nil
+}
+
+func (s *stateStore) get() standbyState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	st := s.state
+	st.Starts = append([]time.Time{}, s.state.Starts...)
+	return st
+}
+
+// started records the process starting, and returns how many times it has started within the window, including
+// this one.
+func (s *stateStore) started(now time.Time, window time.Duration) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	starts := make([]time.Time, 0, len(s.state.Starts)+1)
+	for _, t := range s.state.Starts {
+		if now.Sub(t) < window {
+			starts = append(starts, t)
+		}
+	}
+	s.state.Starts = append(starts, now)
+	return len(s.state.Starts), s.save()
+}
+
+// transition records production being paused or resumed
+func (s *stateStore) transition(paused bool, reason string, now time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !paused && s.state.Paused {
+		s.state.Failovers += 1
+	}
+	s.state.Paused, s.state.Changed, s.state.Reason = paused, now, reason
+	return s.save()
+}
+
+// save writes to a temp file and renames it, a crash while writing leaves the old state
+func (s *stateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".state")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	_ = tmp.Close()
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// lastProduced returns how many blocks before head the account last signed a block, using the reversible block
+// header state. It is -1 if the account hasn't produced recently enough to be listed.
+func lastProduced(api chainReader, account eos.AccountName, head uint32) (int64, error) {
+	bhs, err := api.GetBlockHeaderState(head)
+	if err != nil {
+		return -1, err
+	}
+	if ok, lp := bhs.ProducerToLast(fio.ProducerToLastProduced); ok {
+		for _, prod := range lp {
+			if prod.Producer == account {
+				return int64(head) - int64(prod.BlockNum), nil
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fioprotocol/fio-go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	s, err := loadState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.get().Paused {
+		t.Error("should start paused without a saved state")
+	}
+	now := time.Now()
+	if err = s.transition(false, "missed blocks", now); err != nil {
+		t.Fatal(err)
+	}
+	// resuming when already producing isn't another failover
+	_ = s.transition(false, "resumed by operator", now)
+	_ = s.transition(true, "primary is back", now)
+	_ = s.transition(false, "missed round", now)
+
+	s, err = loadState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.get()
+	if st.Paused || st.Failovers != 2 || st.Reason != "missed round" || !st.Changed.Equal(now.Round(0)) {
+		t.Errorf("state was not saved: %+v", st)
+	}
+
+	// crash loop: starts outside the window are forgotten
+	for i, want := range []int{1, 2, 3} {
+		if n, _ := s.started(now.Add(time.Duration(i)*time.Minute), 10*time.Minute); n != want {
+			t.Errorf("expected %d starts got %d", want, n)
+		}
+	}
+	if n, _ := s.started(now.Add(10*time.Minute+30*time.Second), 10*time.Minute); n != 3 {
+		t.Error("first start should have dropped out of the window, got", n)
+	}
+
+	// a corrupt file still gives a usable store, paused
+	_ = ioutil.WriteFile(file, []byte("{"), 0600)
+	s, err = loadState(file)
+	if err == nil {
+		t.Error("expected error for corrupt state")
+	}
+	if s == nil || !s.get().Paused {
+		t.Fatal("corrupt state should start paused")
+	}
+
+	// without a file, only in memory
+	s, _ = loadState("")
+	if err = s.transition(false, "missed blocks", now); err != nil || s.get().Failovers != 1 {
+		t.Error("memory only state should still work", err)
+	}
+}
+
+func TestLastProduced(t *testing.T) {
+	lp, _ := json.Marshal([]interface{}{testBp, 900})
+	fc := &fakeChain{bhs: &fio.BlockHeaderState{ProducerToLastProduced: []json.RawMessage{lp}}}
+	if d, err := lastProduced(fc, testBp, 1000); err != nil || d != 100 {
+		t.Error("expected 100 blocks got", d, err)
+	}
+	if d, _ := lastProduced(fc, "aproducer111", 1000); d != -1 {
+		t.Error("unlisted producer should be -1, got", d)
+	}
+	if _, err := lastProduced(&fakeChain{}, testBp, 1000); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"github.com/fioprotocol/fio-go/eos/ecc"
+	"log"
+	"sync"
+	"time"
+)
+
+// producerSwitch turns block production on and off for the standby.
+type producerSwitch interface {
+	Name() string
+	Pause() error
+	Resume() error
+	IsPaused() (bool, error)
+}
+
+// localSwitch uses the producer_api_plugin on the standby node.
+type localSwitch struct {
+	api *fio.API
+}
+
+func (l *localSwitch) Name() string {
+	return "producer api"
+}
+
+func (l *localSwitch) Pause() error {
+	return l.api.ProducerPause()
+}
+
+func (l *localSwitch) Resume() error {
+	return l.api.ProducerResume()
+}
+
+func (l *localSwitch) IsPaused() (bool, error) {
+	return l.api.IsProducerPaused()
+}
+
+// keyChain is the subset of the FIO API used to rotate keys
+type keyChain interface {
+	GetProducerSchedule() (*fio.ProducerSchedule, error)
+	GetFioProducers() (*fio.Producers, error)
+	SignPushActions(a ...*fio.Action) (*eos.PushTransactionFullResp, error)
+}
+
+// keySwitch fails over by changing the producer's on-chain signing key. The standby node always runs with its
+// own key and production enabled, but it only signs blocks once the active schedule has its key. Resuming pushes a
+// regproducer update with the standby's key, pausing puts the primary's key back.
+//
+// A key change has to be proposed, then become irreversible before it is in the active schedule, this takes a few
+// minutes. Until the change takes effect (or times out) IsPaused reports the state that was requested so the
+// standby doesn't push the same change again.
+type keySwitch struct {
+	api        keyChain
+	account    eos.AccountName
+	permission string
+	standbyKey string
+	primaryKey string
+	timeout    time.Duration
+
+	mux   sync.Mutex
+	want  string // key waiting to be activated
+	since time.Time
+}
+
+func newKeySwitch(api keyChain, account eos.AccountName, permission, standbyKey, primaryKey string) (*keySwitch, error) {
+	if permission == "" {
+		return nil, errors.New("key rotation requires a delegated permission linked to eosio::regproducer")
+	}
+	sk, err := ecc.NewPublicKey(standbyKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid standby signing key: %w", err)
+	}
+	k := &keySwitch{
+		api:        api,
+		account:    account,
+		permission: permission,
+		standbyKey: sk.String(),
+		timeout:    10 * time.Minute,
+	}
+	if primaryKey == "" {
+		// use the current key, if the standby is not already active
+		p, err := k.producer()
+		if err != nil {
+			return nil, err
+		}
+		if sameKey(p.ProducerPublicKey, k.standbyKey) {
+			return nil, errors.New("the standby key is already registered, the primary key is required")
+		}
+		primaryKey = p.ProducerPublicKey
+	}
+	pk, err := ecc.NewPublicKey(primaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary signing key: %w", err)
+	}
+	k.primaryKey = pk.String()
+	if k.primaryKey == k.standbyKey {
+		return nil, errors.New("primary and standby signing keys must be different")
+	}
+	return k, nil
+}
+
+func (k *keySwitch) Name() string {
+	return "key rotation"
+}
+
+func (k *keySwitch) Pause() error {
+	return k.register(k.primaryKey)
+}
+
+func (k *keySwitch) Resume() error {
+	return k.register(k.standbyKey)
+}
+
+// IsPaused is true unless the standby's key is in the active schedule, or a change to the standby key is waiting
+// to take effect.
+func (k *keySwitch) IsPaused() (bool, error) {
+	active, err := k.scheduled()
+	if err != nil {
+		return false, err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.want != "" {
+		switch {
+		case active == k.want:
+			log.Printf("signing key %s is active after %v", k.want, time.Now().Sub(k.since).Round(time.Second))
+			k.want = ""
+		case time.Now().Sub(k.since) > k.timeout:
+			log.Printf("signing key %s was not in the active schedule after %v, giving up", k.want, k.timeout)
+			k.want = ""
+		default:
+			return k.want != k.standbyKey, nil
+		}
+	}
+	return active != k.standbyKey, nil
+}
+
+// scheduled returns the key for the account in the active schedule, empty if not in the schedule.
+func (k *keySwitch) scheduled() (string, error) {
+	sched, err := k.api.GetProducerSchedule()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range sched.Active.Producers {
+		if p.AccountName == k.account {
+			return p.BlockSigningKey.String(), nil
+		}
+	}
+	return "", nil
+}
+
+func (k *keySwitch) producer() (*fio.Producer, error) {
+	prods, err := k.api.GetFioProducers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range prods.Producers {
+		if prods.Producers[i].Owner == k.account {
+			return &prods.Producers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a registered producer", k.account)
+}
+
+// register pushes a regproducer action keeping the existing url, location and address, only changing the key.
+func (k *keySwitch) register(key string) error {
+	p, err := k.producer()
+	if err != nil {
+		return err
+	}
+	if !sameKey(p.ProducerPublicKey, key) {
+		_, err = k.api.SignPushActions(fio.NewActionWithPermission("eosio", "regproducer", k.account, k.permission,
+			fio.RegProducer{
+				FioAddress: string(p.FioAddress),
+				FioPubKey:  key,
+				Url:        p.Url,
+				Location:   uint16(p.Location),
+				Actor:      k.account,
+				MaxFee:     fio.Tokens(fio.GetMaxFee(fio.FeeRegisterProducer)),
+			}))
+		if err != nil {
+			return err
+		}
+		log.Printf("registered %s with signing key %s, waiting for the schedule to change", k.account, key)
+	}
+	k.mux.Lock()
+	k.want, k.since = key, time.Now()
+	k.mux.Unlock()
+	return nil
+}
+
+// keyRecovery checks there is a way to hand production back after a key failover. Once the standby's key is
+// scheduled the primary can't sign, so the log and fork detectors never see it return. The primary's heartbeat agent
+// keeps reporting while its key is unscheduled, and the heartbeat detector pauses (registering the primary key again)
+// when it says the primary is producing and synced.
+func keyRecovery(detect []Detector, primary *primaryWatch) error {
+	if primary == nil {
+		return errors.New("'-failover key' needs '-heartbeat-listen', heartbeats from the primary are how production is handed back")
+	}
+	for _, d := range detect {
+		if _, ok := d.(*heartbeatDetector); ok {
+			return nil
+		}
+	}
+	return errors.New("'-failover key' needs the heartbeat detector, add 'heartbeat' to '-detect'")
+}
+
+func sameKey(a, b string) bool {
+	ka, err := ecc.NewPublicKey(a)
+	if err != nil {
+		return false
+	}
+	kb, err := ecc.NewPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return ka.String() == kb.String()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"github.com/fioprotocol/fio-go/eos/ecc"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeKeyChain satisfies keyChain, registered keys go straight to the producers table, the schedule only changes
+// when activate is called.
+type fakeKeyChain struct {
+	registered string
+	active     string
+	pushed     []fio.RegProducer
+	fail       bool
+}
+
+func (f *fakeKeyChain) GetProducerSchedule() (*fio.ProducerSchedule, error) {
+	s := &fio.ProducerSchedule{}
+	s.Active.Producers = []fio.ProducerKey{
+		{AccountName: "aproducer111", BlockSigningKey: ecc.MustNewPublicKey(testKey(1))},
+		{AccountName: testBp, BlockSigningKey: ecc.MustNewPublicKey(f.active)},
+	}
+	return s, nil
+}
+
+func (f *fakeKeyChain) GetFioProducers() (*fio.Producers, error) {
+	return &fio.Producers{Producers: []fio.Producer{{
+		Owner:             testBp,
+		FioAddress:        "bp@test",
+		ProducerPublicKey: f.registered,
+		Url:               "https://example.com",
+		Location:          80,
+	}}}, nil
+}
+
+func (f *fakeKeyChain) SignPushActions(a ...*fio.Action) (*eos.PushTransactionFullResp, error) {
+	if f.fail {
+		return nil, errors.New("missing authority")
+	}
+	rp := a[0].ActionData.Data.(fio.RegProducer)
+	if a[0].Authorization[0].Permission != "standby" {
+		return nil, errors.New("wrong permission")
+	}
+	f.pushed = append(f.pushed, rp)
+	f.registered = rp.FioPubKey
+	return &eos.PushTransactionFullResp{}, nil
+}
+
+func (f *fakeKeyChain) activate() {
+	f.active = f.registered
+}
+
+var testKeys = make(map[int]string)
+
+func testKey(i int) string {
+	if testKeys[i] == "" {
+		k, _ := ecc.NewRandomPrivateKey()
+		testKeys[i] = k.PublicKey().String()
+	}
+	return testKeys[i]
+}
+
+func TestKeySwitch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	primary, standby := testKey(2), testKey(3)
+	fc := &fakeKeyChain{registered: primary, active: primary}
+
+	if _, err := newKeySwitch(fc, testBp, "", standby, ""); err == nil {
+		t.Error("should require a permission")
+	}
+	k, err := newKeySwitch(fc, testBp, "standby", standby, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.primaryKey != primary {
+		t.Error("primary key should default to the registered key")
+	}
+	if paused, _ := k.IsPaused(); !paused {
+		t.Error("should be paused when the primary key is scheduled")
+	}
+
+	if err = k.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.pushed) != 1 || fc.pushed[0].FioPubKey != standby || fc.pushed[0].FioAddress != "bp@test" ||
+		fc.pushed[0].Url != "https://example.com" || fc.pushed[0].Location != 80 {
+		t.Fatal("unexpected regproducer", fc.pushed)
+	}
+	// waiting for the schedule, should not look paused
+	if paused, _ := k.IsPaused(); paused {
+		t.Error("should not be paused while waiting for the standby key")
+	}
+	fc.activate()
+	if paused, _ := k.IsPaused(); paused || k.want != "" {
+		t.Error("should not be paused once the standby key is scheduled")
+	}
+
+	if err = k.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if fc.registered != primary {
+		t.Error("pause should restore the primary key")
+	}
+	if paused, _ := k.IsPaused(); !paused {
+		t.Error("should be paused while waiting for the primary key")
+	}
+
+	// timed out waiting on the schedule, report what is actually scheduled
+	k.since = time.Now().Add(-time.Hour)
+	if paused, _ := k.IsPaused(); paused {
+		t.Error("standby key is still scheduled, should not be paused")
+	}
+
+	fc.fail = true
+	if k.Resume() == nil {
+		t.Error("expected error when push fails")
+	}
+
+	// restarted while the standby is active, needs to know the primary key
+	if _, err = newKeySwitch(&fakeKeyChain{registered: standby, active: standby}, testBp, "standby", standby, ""); err == nil {
+		t.Error("expected error when the standby key is registered and no primary key given")
+	}
+}
+
+func TestKeyRecovery(t *testing.T) {
+	primary := newPrimaryWatch(testBp, "secret", nil)
+	withHeartbeat, err := newDetectors("order,heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := newDetectors("order,round")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyRecovery(withHeartbeat, nil) == nil {
+		t.Error("key failover without heartbeats should be refused")
+	}
+	if keyRecovery(without, primary) == nil {
+		t.Error("key failover without the heartbeat detector should be refused")
+	}
+	if err = keyRecovery(withHeartbeat, primary); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The detectors only see the chain through the standby's own node. If the standby is partitioned its head stops
+// moving and it looks exactly like the primary missing blocks. Witnesses are independent read-only endpoints, each
+// one votes on whether the producer is missing from its own view of the chain, and a quorum has to agree before
+// resuming.
+
+// witnessReader is the subset of *fio.API a witness needs
+type witnessReader interface {
+	infoReader
+	chainReader
+}
+
+type witness struct {
+	name string
+	api  witnessReader
+}
+
+type witnessVote struct {
+	witness string
+	missing bool
+	reason  string
+	err     error
+}
+
+func (v witnessVote) String() string {
+	switch {
+	case v.err != nil:
+		return fmt.Sprintf("witness %s: no vote, %v", v.witness, v.err)
+	case v.missing:
+		return fmt.Sprintf("witness %s: missing, %s", v.witness, v.reason)
+	}
+	return fmt.Sprintf("witness %s: producing, %s", v.witness, v.reason)
+}
+
+// witnesses polls all of the witnesses, a nil witnesses always agrees.
+type witnesses struct {
+	list   []witness
+	quorum int
+	limits *tuning
+}
+
+// newWitnesses creates witnesses for a list of urls, a quorum of 0 means a majority.
+func newWitnesses(urls []string, quorum int, limits *tuning) (*witnesses, error) {
+	if len(urls) == 0 {
+		if quorum > 0 {
+			return nil, fmt.Errorf("quorum is %d, but there are no witnesses", quorum)
+		}
+		return nil, nil
+	}
+	if quorum == 0 {
+		quorum = len(urls)/2 + 1
+	}
+	if quorum < 0 || quorum > len(urls) {
+		return nil, fmt.Errorf("quorum must be between 1 and the number of witnesses (%d)", len(urls))
+	}
+	ws := &witnesses{quorum: quorum, limits: limits}
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		api := &fio.API{API: eos.New(u)}
+		api.HttpClient.Timeout = 3 * time.Second
+		ws.list = append(ws.list, witness{name: u, api: api})
+	}
+	return ws, nil
+}
+
+// vote decides if the account is missing based on what a witness sees. Either the head has stopped moving during
+// our turn (the block on the head is ours or our neighbor before us), or we haven't produced for a round.
+func (ws *witnesses) vote(wt witness, account eos.AccountName, before string, now time.Time) witnessVote {
+	v := witnessVote{witness: wt.name}
+	info, err := wt.api.GetInfo()
+	if err != nil {
+		v.err = err
+		return v
+	}
+	limits := ws.limits.get()
+	age := now.Sub(info.HeadBlockTime.Time)
+	ourTurn := info.HeadBlockProducer == account || string(info.HeadBlockProducer) == before
+	if ourTurn && age > limits.WitnessStale {
+		v.missing = true
+		v.reason = fmt.Sprintf("head block %d from %s is %v old", info.HeadBlockNum, info.HeadBlockProducer, age.Round(100*time.Millisecond))
+		return v
+	}
+	distance, err := lastProduced(wt.api, account, info.HeadBlockNum)
+	if err != nil {
+		v.err = err
+		return v
+	}
+	switch {
+	case distance < 0:
+		v.missing = true
+		v.reason = fmt.Sprintf("%s has not produced recently", account)
+		return v
+	case distance >= int64(limits.MissedRoundBlocks):
+		v.missing = true
+		v.reason = fmt.Sprintf("%s has not produced for %d blocks", account, distance)
+		return v
+	}
+	v.reason = fmt.Sprintf("head block %d from %s, %s produced %d blocks ago", info.HeadBlockNum, info.HeadBlockProducer, account, distance)
+	return v
+}
+
+// confirm asks every witness at once and logs each vote, it returns an error unless a quorum agrees the account is
+// missing. Witnesses that can't be reached don't vote.
+func (ws *witnesses) confirm(account eos.AccountName, neighbors *neighbor, now time.Time) error {
+	if ws == nil {
+		return nil
+	}
+	before, _ := neighbors.get()
+	votes := make([]witnessVote, len(ws.list))
+	wg := sync.WaitGroup{}
+	for i := range ws.list {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			votes[i] = ws.vote(ws.list[i], account, before, now)
+		}(i)
+	}
+	wg.Wait()
+
+	missing := 0
+	for _, v := range votes {
+		log.Println(v)
+		if v.missing {
+			missing += 1
+		}
+	}
+	if missing < ws.quorum {
+		return fmt.Errorf("%d of %d witnesses say %s is missing, need %d", missing, len(ws.list), account, ws.quorum)
+	}
+	log.Printf("%d of %d witnesses agree %s is missing", missing, len(ws.list), account)
+	return nil
+}
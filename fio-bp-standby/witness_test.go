@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWitness is a witnessReader with a fixed head and last produced block
+type fakeWitness struct {
+	fakeChain
+	info *eos.InfoResp
+}
+
+func (f *fakeWitness) GetInfo() (*eos.InfoResp, error) {
+	if f.info == nil {
+		return nil, errors.New("connection refused")
+	}
+	return f.info, nil
+}
+
+func newFakeWitness(headProducer string, age time.Duration, produced uint32) *fakeWitness {
+	lp, _ := json.Marshal([]interface{}{testBp, produced})
+	return &fakeWitness{
+		fakeChain: fakeChain{bhs: &fio.BlockHeaderState{ProducerToLastProduced: []json.RawMessage{lp}}},
+		info: &eos.InfoResp{
+			HeadBlockNum:      1000,
+			HeadBlockProducer: eos.AccountName(headProducer),
+			HeadBlockTime:     eos.JSONTime{Time: time.Now().Add(-age)},
+		},
+	}
+}
+
+func TestWitnesses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	n := &neighbor{}
+	n.set("aproducer111", "zproducer111")
+
+	ws, err := newWitnesses([]string{"http://a", "http://b", "http://c"}, 0, newTuning(defaultThresholds()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.quorum != 2 {
+		t.Error("default quorum should be a majority, got", ws.quorum)
+	}
+	set := func(w ...*fakeWitness) {
+		for i := range w {
+			ws.list[i].api = w[i]
+		}
+	}
+
+	// stalled on our turn
+	set(newFakeWitness("aproducer111", 4*time.Second, 760), newFakeWitness(testBp, 3*time.Second, 999), &fakeWitness{})
+	if err = ws.confirm(testBp, n, time.Now()); err != nil {
+		t.Error("two witnesses see the head stalled on our turn:", err)
+	}
+
+	// standby is partitioned, the witnesses see the head moving
+	set(newFakeWitness(testBp, 200*time.Millisecond, 999), newFakeWitness("zproducer111", 300*time.Millisecond, 990), newFakeWitness("aproducer111", 4*time.Second, 760))
+	if err = ws.confirm(testBp, n, time.Now()); err == nil || !strings.Contains(err.Error(), "1 of 3") {
+		t.Error("only one witness should vote missing:", err)
+	}
+
+	// missed rounds, the head is moving but we haven't produced
+	set(newFakeWitness("mproducer111", 0, 500), newFakeWitness("mproducer111", 0, 600), newFakeWitness("mproducer111", 0, 900))
+	if err = ws.confirm(testBp, n, time.Now()); err != nil {
+		t.Error("two witnesses see missed rounds:", err)
+	}
+
+	// unreachable witnesses don't count
+	set(&fakeWitness{}, &fakeWitness{}, newFakeWitness("aproducer111", 4*time.Second, 760))
+	if err = ws.confirm(testBp, n, time.Now()); err == nil {
+		t.Error("unreachable witnesses should not vote")
+	}
+
+	var none *witnesses
+	if none.confirm(testBp, n, time.Now()) != nil {
+		t.Error("no witnesses should always confirm")
+	}
+	if _, err = newWitnesses([]string{"http://a"}, 2, nil); err == nil {
+		t.Error("quorum larger than the witnesses should fail")
+	}
+	if _, err = newWitnesses(nil, 1, nil); err == nil {
+		t.Error("quorum without witnesses should fail")
+	}
+}
@@ -0,0 +1,175 @@
+package voter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// bp.json is checked against the standard at https://github.com/eosrio/bp-info-standard, every check counts towards
+// the completeness score and each failure is listed by field.
+
+// bpJsonReport collects the checks
+type bpJsonReport struct {
+	checks   int
+	problems []string
+}
+
+func (r *bpJsonReport) check(ok bool, field string, problem string, a ...interface{}) {
+	r.checks += 1
+	if !ok {
+		r.problems = append(r.problems, field+": "+fmt.Sprintf(problem, a...))
+	}
+}
+
+// complete is the percentage of checks that passed
+func (r *bpJsonReport) complete() int {
+	if r.checks == 0 {
+		return 0
+	}
+	return (r.checks - len(r.problems)) * 100 / r.checks
+}
+
+var nodeTypes = map[string]bool{"producer": true, "full": true, "query": true, "seed": true}
+
+// countryCodes are ISO 3166-1 alpha-2
+var countryCodes = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, c := range strings.Fields(`AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO
+		BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER
+		ES ET FI FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN
+		IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH
+		MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN
+		PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ
+		TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW`) {
+		codes[c] = true
+	}
+	return codes
+}()
+
+func validUrl(s string, schemes ...string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *bpJsonReport) location(field string, l fio.BpJsonLocation) {
+	r.check(l.Name != "", field+".name", "missing")
+	r.check(countryCodes[l.Country], field+".country", "'%s' is not an ISO 3166-1 alpha-2 country code", l.Country)
+	r.check(l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180,
+		field, "latitude %v, longitude %v is not a valid position", l.Latitude, l.Longitude)
+}
+
+// nodeType returns the types for a node, node_type can be a string or a list
+func nodeType(t interface{}) []string {
+	switch v := t.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		types := make([]string, 0, len(v))
+		for i := range v {
+			types = append(types, fmt.Sprint(v[i]))
+		}
+		return types
+	}
+	return nil
+}
+
+// validateBpJson checks the required fields, the account, and each node. candidate_name is free text, only the
+// account in producer_account_name can be compared.
+func validateBpJson(bpj *fio.BpJson, account string) *bpJsonReport {
+	r := &bpJsonReport{}
+	r.check(bpj.ProducerAccountName == account, "producer_account_name",
+		"'%s' does not match the account %s", bpj.ProducerAccountName, account)
+
+	org := bpj.Org
+	r.check(org.CandidateName != "", "org.candidate_name", "missing")
+	r.check(validUrl(org.Website, "https", "http"), "org.website", "'%s' is not a url", org.Website)
+	r.check(validUrl(org.CodeOfConduct, "https", "http"), "org.code_of_conduct", "'%s' is not a url", org.CodeOfConduct)
+	r.check(validUrl(org.OwnershipDisclosure, "https", "http"), "org.ownership_disclosure", "'%s' is not a url", org.OwnershipDisclosure)
+	_, err := mail.ParseAddress(org.Email)
+	r.check(err == nil, "org.email", "'%s' is not an email address", org.Email)
+	r.check(validUrl(org.Branding.Logo256, "https"), "org.branding.logo_256", "'%s' is not an https url", org.Branding.Logo256)
+	r.check(validUrl(org.Branding.Logo1024, "https"), "org.branding.logo_1024", "'%s' is not an https url", org.Branding.Logo1024)
+	r.check(validUrl(org.Branding.LogoSvg, "https"), "org.branding.logo_svg", "'%s' is not an https url", org.Branding.LogoSvg)
+	r.location("org.location", org.Location)
+
+	r.check(len(bpj.Nodes) > 0, "nodes", "none listed")
+	var producer bool
+	for i, node := range bpj.Nodes {
+		field := fmt.Sprintf("nodes[%d]", i)
+		types := nodeType(node.NodeType)
+		valid := len(types) > 0
+		for _, t := range types {
+			valid = valid && nodeTypes[t]
+			switch t {
+			case "producer":
+				producer = true
+			case "query":
+				r.check(node.ApiEndpoint != "" || node.SslEndpoint != "", field, "query node has no api_endpoint or ssl_endpoint")
+			case "seed":
+				r.check(node.P2pEndpoint != "", field, "seed node has no p2p_endpoint")
+			}
+		}
+		r.check(valid, field+".node_type", "%v is not producer, full, query or seed", node.NodeType)
+		r.location(field+".location", node.Location)
+		if node.ApiEndpoint != "" {
+			r.check(validUrl(node.ApiEndpoint, "http", "https"), field+".api_endpoint", "'%s' is not a url", node.ApiEndpoint)
+		}
+		if node.SslEndpoint != "" {
+			r.check(validUrl(node.SslEndpoint, "https"), field+".ssl_endpoint", "'%s' is not an https url", node.SslEndpoint)
+		}
+		if node.P2pEndpoint != "" {
+			u, err := url.Parse("tcp://" + node.P2pEndpoint)
+			r.check(err == nil && u.Hostname() != "" && u.Port() != "", field+".p2p_endpoint", "'%s' is not host:port", node.P2pEndpoint)
+		}
+	}
+	r.check(producer, "nodes", "no producer node")
+	return r
+}
+
+// checkChains makes sure chains.json, if there is one, points this chain's id to the bp.json that was loaded. fio-go
+// quietly falls back to bp.json when the file it points to can't be read.
+func (r *bpJsonReport) checkChains(client *http.Client, bpJsonUrl string, chainId string) {
+	u, err := url.Parse(bpJsonUrl)
+	if err != nil {
+		return
+	}
+	resp, err := client.Get(u.Scheme + "://" + u.Host + "/chains.json")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	chains := &fio.ChainsJson{}
+	err = json.Unmarshal(body, chains)
+	r.check(err == nil, "chains.json", "invalid: %v", err)
+	if err != nil {
+		return
+	}
+	file, ok := chains.Chains[chainId]
+	r.check(ok, "chains.json", "no entry for chain id %s", chainId)
+	if ok {
+		r.check(path.Clean("/"+file) == path.Clean(u.Path), "chains.json",
+			"%s for this chain could not be loaded, %s was used instead", file, u.Path)
+	}
+}
@@ -0,0 +1,115 @@
+package voter
+
+import (
+	"encoding/json"
+	"github.com/fioprotocol/fio-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testBpJson = `{
+  "producer_account_name": "qbxn5zhw2ypw",
+  "org": {
+    "candidate_name": "Blockpane",
+    "website": "https://blockpane.com",
+    "code_of_conduct": "https://blockpane.com/coc.html",
+    "ownership_disclosure": "https://blockpane.com/ownership.html",
+    "email": "ops@blockpane.com",
+    "branding": {
+      "logo_256": "https://blockpane.com/logo_256.png",
+      "logo_1024": "https://blockpane.com/logo_1024.png",
+      "logo_svg": "https://blockpane.com/logo.svg"
+    },
+    "location": {"name": "Denver", "country": "US", "latitude": 39.74, "longitude": -104.99}
+  },
+  "nodes": [
+    {"location": {"name": "Denver", "country": "US", "latitude": 39.74, "longitude": -104.99}, "node_type": "producer"},
+    {
+      "location": {"name": "Frankfurt", "country": "DE", "latitude": 50.11, "longitude": 8.68},
+      "node_type": ["query", "seed"],
+      "api_endpoint": "http://fio.blockpane.com:8888",
+      "ssl_endpoint": "https://fio.blockpane.com",
+      "p2p_endpoint": "fio.blockpane.com:9876"
+    }
+  ]
+}`
+
+func TestValidateBpJson(t *testing.T) {
+	bpj := &fio.BpJson{}
+	if err := json.Unmarshal([]byte(testBpJson), bpj); err != nil {
+		t.Fatal(err)
+	}
+	r := validateBpJson(bpj, "qbxn5zhw2ypw")
+	if r.complete() != 100 || len(r.problems) != 0 {
+		t.Errorf("expected a complete bp.json, got %d%%: %v", r.complete(), r.problems)
+	}
+
+	bpj.ProducerAccountName = "htjonrkf1lgs"
+	bpj.Org.Email = "ops at blockpane"
+	bpj.Org.Branding.LogoSvg = "http://blockpane.com/logo.svg"
+	bpj.Nodes[0].NodeType = "validator"
+	bpj.Nodes[1].Location.Country = "USA"
+	bpj.Nodes[1].P2pEndpoint = ""
+	r = validateBpJson(bpj, "qbxn5zhw2ypw")
+	problems := strings.Join(r.problems, "\n")
+	for _, want := range []string{
+		"producer_account_name: 'htjonrkf1lgs' does not match the account qbxn5zhw2ypw",
+		"org.email:",
+		"org.branding.logo_svg:",
+		"nodes[0].node_type: validator is not",
+		"nodes[1].location.country: 'USA'",
+		"nodes[1]: seed node has no p2p_endpoint",
+		"nodes: no producer node",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("expected '%s' in:\n%s", want, problems)
+		}
+	}
+	if len(r.problems) != 7 || r.complete() >= 100 || r.complete() <= 0 {
+		t.Errorf("unexpected score %d%% for %d problems", r.complete(), len(r.problems))
+	}
+}
+
+func TestCheckChains(t *testing.T) {
+	const chainId = "21dcae42c0182200e93f954a074011f9048a7624c6fe81d3c9541a614a88bd1c"
+	chains := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chains.json" || chains == "" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(chains))
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		chains, used string
+		problem      string
+	}{
+		{"", "/bp.json", ""},
+		{`{"chains": {"` + chainId + `": "bp.fio.json"}}`, "/bp.fio.json", ""},
+		{`{"chains": {"` + chainId + `": "/bp.fio.json"}}`, "/bp.json", "bp.fio.json for this chain could not be loaded"},
+		{`{"chains": {"other": "bp.fio.json"}}`, "/bp.json", "no entry for chain id"},
+		{`{"chains": [`, "/bp.json", "chains.json: invalid"},
+	} {
+		chains = c.chains
+		r := &bpJsonReport{}
+		r.checkChains(server.Client(), server.URL+c.used, chainId)
+		switch {
+		case c.problem == "" && len(r.problems) != 0:
+			t.Errorf("%s: unexpected problems %v", c.chains, r.problems)
+		case c.problem != "" && (len(r.problems) != 1 || !strings.Contains(r.problems[0], c.problem)):
+			t.Errorf("%s: expected '%s', got %v", c.chains, c.problem, r.problems)
+		}
+	}
+
+	// the prober's client won't fetch it from a private address
+	chains = `{"chains": {"other": "bp.fio.json"}}`
+	r := &bpJsonReport{}
+	r.checkChains(newProber().client, server.URL+"/bp.json", chainId)
+	if r.checks != 0 {
+		t.Errorf("chains.json on a private address should not be checked, got %v", r.problems)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	voter "github.com/blockpane/fio-tools/fio-bp-vote"
@@ -9,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -26,8 +28,69 @@ func main() {
 	flag.IntVar(&voter.NumVotes, "n", 30, "how many (max) producers to vote for")
 	flag.BoolVar(&voter.Dry, "dry-run", false, "don't push transactions, only print what would have been done.")
 	flag.BoolVar(&voter.V, "v", false, "verbose logging")
+	policy := flag.String("policy", "", "YAML scoring policy, uses the built-in policy if not set")
+	flag.BoolVar(&voter.Proxy, "proxy", false, "register the actor as a voting proxy (regproxy) and vote as the proxy")
+	unreg := flag.Bool("unregproxy", false, "unregister the actor as a voting proxy and exit")
+	follow := flag.String("follow", "", "proxy the actor's votes to this proxy's FIO address (voteproxy) and exit")
+	ranks := flag.String("ranks", "ranks.json", "ranks file to read for 'explain'")
+	flag.StringVar(&voter.HistoryFile, "history", "", "file to append each ranking run to, no history is kept if not set")
 	flag.Parse()
 
+	// history [fio address] shows score trends, diff [from to] shows who moved in or out of the vote set
+	if flag.Arg(0) == "history" || flag.Arg(0) == "diff" {
+		if voter.HistoryFile == "" {
+			fmt.Println("-history is required, it is the file the runs were saved to")
+			os.Exit(1)
+		}
+		runs, err := voter.ReadHistory(voter.HistoryFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		switch {
+		case flag.Arg(0) == "history" && flag.NArg() <= 2:
+			err = voter.PrintHistory(os.Stdout, runs, flag.Arg(1))
+		case flag.Arg(0) == "diff" && flag.NArg() == 1:
+			err = voter.PrintDiff(os.Stdout, runs, len(runs)-1, len(runs))
+		case flag.Arg(0) == "diff" && flag.NArg() == 3:
+			from, e1 := strconv.Atoi(flag.Arg(1))
+			to, e2 := strconv.Atoi(flag.Arg(2))
+			if e1 != nil || e2 != nil {
+				err = errors.New("runs are given by number, as listed by 'history'")
+				break
+			}
+			err = voter.PrintDiff(os.Stdout, runs, from, to)
+		default:
+			err = errors.New("usage: fio-bp-vote -history file history [fio address] | diff [from to]")
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// explain <fio address> prints how a producer was scored in the last run
+	if flag.Arg(0) == "explain" {
+		if flag.NArg() != 2 {
+			fmt.Println("usage: fio-bp-vote [-ranks file] explain <fio address>")
+			os.Exit(1)
+		}
+		if err := voter.ExplainRank(os.Stdout, *ranks, flag.Arg(1)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch {
+	case *unreg && (*follow != "" || voter.Proxy):
+		fmt.Println("-unregproxy cannot be used with -follow or -proxy")
+		os.Exit(1)
+	case *follow != "" && voter.Proxy:
+		fmt.Println("-follow cannot be used with -proxy, a proxy votes for producers itself and can't proxy its votes")
+		os.Exit(1)
+	}
 	switch "" {
 	case voter.Url, voter.Actor, voter.Key, voter.Address:
 		fmt.Println("invalid options, use '-h' for help.")
@@ -36,6 +99,23 @@ func main() {
 	if voter.Perm == "" {
 		voter.Perm = voter.Actor + "@" + "active"
 	}
+
+	// proxy management runs once and exits
+	if *unreg || *follow != "" {
+		_, api, _, err := fio.NewWifConnect(voter.Key, voter.Url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *unreg {
+			err = voter.UnregisterProxy(api)
+		} else {
+			err = voter.FollowProxy(api, *follow)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if voter.Allowed == "" {
 		log.Println("no allowed-producers list provided: will consider any block producer for voting. \n***** Are you sure this is what you want? *****")
 	} else {
@@ -49,7 +129,15 @@ func main() {
 		}
 	}
 
-	log.Println("fio-voter starting")
+	if *policy != "" {
+		p, err := voter.LoadPolicy(*policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		voter.Scoring = p
+	}
+
+	log.Printf("fio-voter starting, scoring with the %s policy", voter.Scoring.Name)
 
 	// best effort to save and reload status
 	func() {
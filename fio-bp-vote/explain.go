@@ -0,0 +1,64 @@
+package voter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+)
+
+// ExplainRank prints the score breakdown for one producer from a ranks.json file written by RankProducers.
+func ExplainRank(w io.Writer, file string, address string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	ranks := make([]*BpRank, 0)
+	if err = json.Unmarshal(b, &ranks); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	var bp *BpRank
+	for i := range ranks {
+		if strings.EqualFold(string(ranks[i].Address), address) {
+			bp = ranks[i]
+			break
+		}
+	}
+	if bp == nil {
+		return fmt.Errorf("%s is not in %s", address, file)
+	}
+
+	header := string(bp.Address)
+	if bp.Account != "" {
+		header += " (" + string(bp.Account) + ")"
+	}
+	header += fmt.Sprintf(" score %d", bp.Score)
+	if bp.Time != "" {
+		header += ", ranked " + bp.Time
+	}
+	fmt.Fprintln(w, header)
+	if bp.Excluded != "" {
+		fmt.Fprintln(w, "excluded:", bp.Excluded)
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "criterion\tvalue\tweight\tpoints\tnote")
+	var total int
+	for _, item := range bp.Explain {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\t%s\n", item.Criterion, item.Value, item.Weight, item.Points, item.Note)
+		total += item.Points
+	}
+	fmt.Fprintf(tw, "total\t\t\t%+d\t\n", total)
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	if bp.BpJson {
+		fmt.Fprintf(w, "\nbp.json is %d%% complete\n", bp.BpJsonComplete)
+		for _, problem := range bp.BpJsonErrors {
+			fmt.Fprintln(w, "    "+problem)
+		}
+	}
+	return nil
+}
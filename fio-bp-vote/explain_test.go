@@ -0,0 +1,84 @@
+package voter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExplainRank(t *testing.T) {
+	bp := &BpRank{
+		Address:     "bp@dapixdev",
+		Account:     "qbxn5zhw2ypw",
+		bpPubKey:    "FIOkey1",
+		bpSignKey:   "FIOkey1",
+		FeeVote:     40,
+		Compute:     2,
+		CpuScore:    -6,
+		RegValidUrl: true,
+		hasNoVotes:  true,
+	}
+	bp.score(DefaultPolicy())
+	items := make(map[string]ScoreItem)
+	var total int
+	for _, item := range bp.Explain {
+		items[item.Criterion] = item
+		total += item.Points
+	}
+	if total != bp.Score || len(bp.Explain) != len(DefaultPolicy().Criteria) {
+		t.Errorf("explanation doesn't add up to the score %d: %+v", bp.Score, bp.Explain)
+	}
+	for name, want := range map[string]ScoreItem{
+		"fee_vote": {Criterion: "fee_vote", Value: 40, Weight: 2, Points: 60, Note: "capped at 60"},
+		"compute":  {Criterion: "compute", Value: 2, Weight: 1, Points: 2, Note: "last 1d"},
+		"cpu":      {Criterion: "cpu", Value: -6, Weight: 1, Points: -6, Note: "average transaction cpu over 7000µs"},
+		"votes":    {Criterion: "votes", Points: -200, Note: "penalty"},
+		"claimed":  {Criterion: "claimed", Points: -100, Note: "penalty"},
+	} {
+		if items[name] != want {
+			t.Errorf("expected %+v, got %+v", want, items[name])
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missed := &BpRank{Address: "bp@missing", MissingExcluded: true, Explain: []ScoreItem{{
+		Criterion: "missed_round",
+		Note:      "missed a round, excluded until " + time.Now().UTC().Format(time.RFC3339),
+	}}}
+	inactive := &BpRank{Address: "bp@inactive", Excluded: "inactive in the producers table", Explain: []ScoreItem{{
+		Criterion: "excluded",
+		Note:      "inactive in the producers table",
+	}}}
+	j, _ := json.Marshal([]*BpRank{bp, missed, inactive})
+	file := filepath.Join(dir, "ranks.json")
+	if err = ioutil.WriteFile(file, j, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err = ExplainRank(out, file, "BP@dapixdev"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "capped at 60") || !strings.Contains(out.String(), "total") {
+		t.Error("unexpected output:\n", out.String())
+	}
+	out.Reset()
+	if err = ExplainRank(out, file, "bp@missing"); err != nil || !strings.Contains(out.String(), "missed a round") {
+		t.Error("expected the exclusion reason, got", err, out.String())
+	}
+	out.Reset()
+	if err = ExplainRank(out, file, "bp@inactive"); err != nil || !strings.Contains(out.String(), "excluded: inactive") {
+		t.Error("expected the exclusion reason, got", err, out.String())
+	}
+	if err = ExplainRank(out, file, "bp@unknown"); err == nil {
+		t.Error("expected an error for a producer that isn't ranked")
+	}
+}
@@ -0,0 +1,307 @@
+package voter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// HistoryFile gets a line appended for every vote run, empty (the default) to disable. It is never rotated, each
+// line is tens of KB at most.
+var HistoryFile = ""
+
+// lastRanks is what RankProducers saved to ranks.json
+var lastRanks []*BpRank
+
+// what happened to the vote in a run
+const (
+	VotePushed    = "pushed"    // the new vote was accepted
+	VoteFailed    = "failed"    // the transaction could not be pushed, the previous vote still stands
+	VoteUnchanged = "unchanged" // the ranking picked the same producers as the last vote
+	VoteDryRun    = "dry-run"
+)
+
+// RankRun is one line in the history file, the ranks are in the same order as ranks.json at the time.
+type RankRun struct {
+	Time   time.Time      `json:"time"`
+	Policy string         `json:"policy"`
+	Dry    bool           `json:"dry_run"`
+	Status string         `json:"status,omitempty"` // empty in files written before it was recorded
+	Voted  []string       `json:"voted"`            // in rank order
+	Ranks  []*HistoryRank `json:"ranks"`
+}
+
+// HistoryRank is the part of a BpRank the history needs, the logo and counters are left out to keep the file small.
+type HistoryRank struct {
+	Address         fio.Address    `json:"address"`
+	Score           int            `json:"score"`
+	MissingExcluded bool           `json:"missing_excluded,omitempty"`
+	Excluded        string         `json:"excluded,omitempty"`
+	Points          map[string]int `json:"points,omitempty"` // by criterion, from the explanation
+}
+
+// historyRanks trims ranks for the history file
+func historyRanks(ranks []*BpRank) []*HistoryRank {
+	h := make([]*HistoryRank, 0, len(ranks))
+	for _, bp := range ranks {
+		hr := &HistoryRank{Address: bp.Address, Score: bp.Score, MissingExcluded: bp.MissingExcluded, Excluded: bp.Excluded}
+		for _, item := range bp.Explain {
+			if item.Points == 0 {
+				continue
+			}
+			if hr.Points == nil {
+				hr.Points = make(map[string]int)
+			}
+			hr.Points[item.Criterion] = item.Points
+		}
+		h = append(h, hr)
+	}
+	return h
+}
+
+// AppendHistory adds a run to the end of the history file
+func AppendHistory(file string, run *RankRun) error {
+	j, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(j, '\n'))
+	return err
+}
+
+// ReadHistory returns every run in the history file, oldest first.
+func ReadHistory(file string) ([]*RankRun, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	runs := make([]*RankRun, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		run := &RankRun{}
+		if err = json.Unmarshal(scanner.Bytes(), run); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, line, err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, scanner.Err()
+}
+
+func (run *RankRun) find(address string) (rank *HistoryRank, position int) {
+	for i := range run.Ranks {
+		if strings.EqualFold(string(run.Ranks[i].Address), address) {
+			return run.Ranks[i], i + 1
+		}
+	}
+	return nil, 0
+}
+
+func (run *RankRun) voted(address string) bool {
+	for _, v := range run.Voted {
+		if strings.EqualFold(v, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintHistory lists the runs and the score trend for each producer, or every run for one producer if an address is
+// given.
+func PrintHistory(w io.Writer, runs []*RankRun, address string) error {
+	if len(runs) == 0 {
+		return errors.New("no history")
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if address != "" {
+		var found bool
+		fmt.Fprintln(tw, "run\ttime\tscore\tposition\tvoted\tnote")
+		for i, run := range runs {
+			bp, pos := run.find(address)
+			if bp == nil {
+				fmt.Fprintf(tw, "%d\t%s\t\t\t%v\tnot ranked\n", i+1, run.Time.Format(time.RFC3339), run.voted(address))
+				continue
+			}
+			found = true
+			var note string
+			switch {
+			case bp.MissingExcluded:
+				note = "excluded, missed a round"
+			case bp.Excluded != "":
+				note = "excluded, " + bp.Excluded
+			case run.Status == VoteFailed:
+				note = "vote failed"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%v\t%s\n", i+1, run.Time.Format(time.RFC3339), bp.Score, pos, run.voted(address), note)
+		}
+		if !found {
+			return fmt.Errorf("%s is not in the history", address)
+		}
+		return tw.Flush()
+	}
+
+	fmt.Fprintln(tw, "run\ttime\tpolicy\tvotes\tstatus")
+	for i, run := range runs {
+		status := run.Status
+		if status == "" && run.Dry {
+			status = VoteDryRun
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", i+1, run.Time.Format(time.RFC3339), run.Policy, len(run.Voted), status)
+	}
+	fmt.Fprintln(tw)
+
+	type trend struct {
+		address                          string
+		runs, voted, first, last, lo, hi int
+	}
+	trends := make(map[string]*trend)
+	for _, run := range runs {
+		for _, bp := range run.Ranks {
+			if bp.MissingExcluded || bp.Excluded != "" {
+				continue
+			}
+			t := trends[string(bp.Address)]
+			if t == nil {
+				t = &trend{address: string(bp.Address), first: bp.Score, lo: bp.Score, hi: bp.Score}
+				trends[string(bp.Address)] = t
+			}
+			t.runs += 1
+			t.last = bp.Score
+			// a failed push left the previous vote in place
+			if run.Status != VoteFailed && run.voted(t.address) {
+				t.voted += 1
+			}
+			if bp.Score < t.lo {
+				t.lo = bp.Score
+			}
+			if bp.Score > t.hi {
+				t.hi = bp.Score
+			}
+		}
+	}
+	sorted := make([]*trend, 0, len(trends))
+	for _, t := range trends {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].last == sorted[j].last {
+			return sorted[i].address < sorted[j].address
+		}
+		return sorted[i].last > sorted[j].last
+	})
+	fmt.Fprintln(tw, "producer\truns\tvoted\tfirst\tlast\tchange\tlow\thigh")
+	for _, t := range sorted {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%+d\t%d\t%d\n", t.address, t.runs, t.voted, t.first, t.last, t.last-t.first, t.lo, t.hi)
+	}
+	return tw.Flush()
+}
+
+// Movement is a producer that entered or left the vote set between two runs.
+type Movement struct {
+	Address string `json:"address"`
+	In      bool   `json:"in"`
+	Reason  string `json:"reason"`
+}
+
+// DiffRuns finds who moved in or out of the vote set between two runs and why.
+func DiffRuns(from, to *RankRun) []Movement {
+	moved := make([]Movement, 0)
+	for _, address := range from.Voted {
+		if !to.voted(address) {
+			moved = append(moved, Movement{Address: address, Reason: movedReason(address, from, to, false)})
+		}
+	}
+	for _, address := range to.Voted {
+		if !from.voted(address) {
+			moved = append(moved, Movement{Address: address, In: true, Reason: movedReason(address, from, to, true)})
+		}
+	}
+	return moved
+}
+
+func movedReason(address string, from, to *RankRun, in bool) string {
+	before, beforePos := from.find(address)
+	after, afterPos := to.find(address)
+	switch {
+	case after == nil:
+		return "no longer ranked"
+	case after.MissingExcluded:
+		return "excluded for missing a round"
+	case after.Excluded != "":
+		return "excluded, " + after.Excluded
+	case before == nil:
+		return fmt.Sprintf("newly ranked at %d with a score of %d", afterPos, after.Score)
+	case before.MissingExcluded:
+		return fmt.Sprintf("no longer excluded for missing a round, ranked %d with a score of %d", afterPos, after.Score)
+	case before.Excluded != "":
+		return fmt.Sprintf("no longer excluded (%s), ranked %d with a score of %d", before.Excluded, afterPos, after.Score)
+	}
+	reason := fmt.Sprintf("score %d → %d, position %d → %d", before.Score, after.Score, beforePos, afterPos)
+	if changed := changedCriteria(before, after); len(changed) > 0 {
+		return reason + ": " + strings.Join(changed, ", ")
+	}
+	if in {
+		return reason + ", others dropped below it"
+	}
+	return reason + ", others scored higher"
+}
+
+// changedCriteria lists the criteria with different points
+func changedCriteria(before, after *HistoryRank) []string {
+	names := make([]string, 0, len(before.Points)+len(after.Points))
+	for name := range before.Points {
+		names = append(names, name)
+	}
+	for name := range after.Points {
+		if _, ok := before.Points[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changed := make([]string, 0)
+	for _, name := range names {
+		if before.Points[name] != after.Points[name] {
+			changed = append(changed, fmt.Sprintf("%s %+d → %+d", name, before.Points[name], after.Points[name]))
+		}
+	}
+	return changed
+}
+
+// PrintDiff prints the movements between runs, numbered from 1 as listed by PrintHistory.
+func PrintDiff(w io.Writer, runs []*RankRun, from, to int) error {
+	if from < 1 || to < 1 || from > len(runs) || to > len(runs) {
+		return fmt.Errorf("runs are numbered 1 to %d", len(runs))
+	}
+	a, b := runs[from-1], runs[to-1]
+	fmt.Fprintf(w, "run %d (%s) → run %d (%s)\n\n", from, a.Time.Format(time.RFC3339), to, b.Time.Format(time.RFC3339))
+	moved := DiffRuns(a, b)
+	if len(moved) == 0 {
+		fmt.Fprintln(w, "no changes to the vote set")
+		return nil
+	}
+	for _, m := range moved {
+		direction := "out"
+		if m.In {
+			direction = "in "
+		}
+		fmt.Fprintf(w, "%s  %-30s %s\n", direction, m.Address, m.Reason)
+	}
+	return nil
+}
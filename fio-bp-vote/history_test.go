@@ -0,0 +1,125 @@
+package voter
+
+import (
+	"bytes"
+	"github.com/fioprotocol/fio-go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ranks-history.jsonl")
+
+	rank := func(address string, fees int, missing bool) *BpRank {
+		bp := &BpRank{Address: fio.Address("bp@" + address), FeeVote: fees, HasClaimed: true, MissingExcluded: missing}
+		bp.score(DefaultPolicy())
+		bp.Svg = strings.Repeat("<svg/>", 1000)
+		return bp
+	}
+	first := &RankRun{
+		Time:   time.Now().Add(-24 * time.Hour),
+		Policy: "default",
+		Voted:  []string{"bp@one", "bp@two", "bp@three", "bp@six"},
+		Ranks:  historyRanks([]*BpRank{rank("one", 30, false), rank("two", 20, false), rank("three", 10, false), rank("six", 6, false), rank("four", 5, false)}),
+	}
+	second := &RankRun{
+		Time:   time.Now(),
+		Policy: "default",
+		Voted:  []string{"bp@one", "bp@four", "bp@five"},
+		Ranks: historyRanks([]*BpRank{rank("one", 30, false), rank("four", 25, false), rank("five", 3, false), rank("three", 1, false), rank("two", 0, true),
+			{Address: "bp@six", Excluded: "not on the allowed list"}}),
+	}
+	for _, run := range []*RankRun{first, second} {
+		if err = AppendHistory(file, run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, _ := ioutil.ReadFile(file); strings.Contains(string(b), "svg") {
+		t.Error("the history should not keep the logo")
+	}
+	runs, err := ReadHistory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || len(runs[1].Ranks) != 6 || runs[1].Ranks[1].Score != second.Ranks[1].Score {
+		t.Fatalf("history was not read back correctly: %+v", runs)
+	}
+
+	reasons := make(map[string]Movement)
+	for _, m := range DiffRuns(runs[0], runs[1]) {
+		reasons[m.Address] = m
+	}
+	for address, want := range map[string]string{
+		"bp@two":   "excluded for missing a round",
+		"bp@three": "fee_vote +20 → +2",
+		"bp@four":  "position 5 → 2",
+		"bp@six":   "excluded, not on the allowed list",
+		"bp@five":  "newly ranked at 3",
+	} {
+		if !strings.Contains(reasons[address].Reason, want) {
+			t.Errorf("%s: expected '%s' in '%s'", address, want, reasons[address].Reason)
+		}
+	}
+	if len(reasons) != 5 || !reasons["bp@five"].In || reasons["bp@two"].In {
+		t.Errorf("unexpected movements %+v", reasons)
+	}
+
+	out := &bytes.Buffer{}
+	if err = PrintHistory(out, runs, "bp@four"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[2], "true") {
+		t.Error("unexpected history for bp@four:\n", out.String())
+	}
+	out.Reset()
+	if err = PrintHistory(out, runs, ""); err != nil || !strings.Contains(out.String(), "bp@four") {
+		t.Error("unexpected trends:", err, "\n", out.String())
+	}
+	if err = PrintDiff(out, runs, 1, 3); err == nil {
+		t.Error("expected an error for a run that doesn't exist")
+	}
+}
+
+func TestSaveHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(f string, r []*BpRank) { HistoryFile, lastRanks = f, r }(HistoryFile, lastRanks)
+	HistoryFile = filepath.Join(dir, "ranks-history.jsonl")
+	lastRanks = []*BpRank{{Address: "bp@one", Score: 10}, {Address: "bp@two", Score: 5}}
+
+	saveHistory([]string{"bp@one", "bp@two"}, VotePushed)
+	saveHistory([]string{"bp@two", "bp@one"}, VoteFailed)
+	runs, err := ReadHistory(HistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].Status != VotePushed || runs[1].Status != VoteFailed || runs[1].Voted[0] != "bp@two" {
+		t.Fatalf("unexpected runs %+v %+v", runs[0], runs[1])
+	}
+
+	// the failed run doesn't count as a vote in the trends
+	out := &bytes.Buffer{}
+	if err = PrintHistory(out, runs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), VoteFailed) {
+		t.Error("the run list should show the failed vote:\n", out.String())
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if f := strings.Fields(line); len(f) > 2 && f[0] == "bp@one" && f[2] != "1" {
+			t.Error("expected bp@one to be voted for in one run:", line)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package voter
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides how producers are scored. Each criterion is something that can be checked on-chain, a proxy can
+// publish its own policy file to describe what it votes for.
+type Policy struct {
+	Name        string               `yaml:"name"`
+	Description string               `yaml:"description"`
+	Criteria    map[string]Criterion `yaml:"criteria"`
+}
+
+// Criterion is scored as weight points for each action (or once if it's a yes/no check), up to the cap. If there
+// are no actions (or the check fails) the penalty is subtracted instead. Actions only count within the window.
+type Criterion struct {
+	Weight  int           `yaml:"weight"`
+	Cap     int           `yaml:"cap"`     // maximum points, 0 for no limit
+	Window  time.Duration `yaml:"window"`  // how far back to count actions, only for counted criteria
+	Penalty int           `yaml:"penalty"` // subtracted when not met
+}
+
+// criteria are the names that can be used in a policy, and if they count actions
+var criteria = map[string]bool{
+	"msig":          true,  // propose, approve and exec
+	"fee_vote":      true,  // setfeevote, setfeemult, bundlevote and mandatoryfee
+	"compute":       true,  // computefees
+	"bpclaim":       true,  // bpclaim
+	"tpidclaim":     true,  // tpidclaim
+	"burnexpired":   true,  // burnexpired
+	"cpu":           false, // the score from CpuRanking, negative for slow producers
+	"diff_sign_key": false, // signing key is not the key for the fio address
+	"linked_auth":   false, // uses a linked permission or msig for its actions
+	"valid_url":     false, // url in the producers table is reachable
+	"bp_json":       false, // url has a bp.json with nodes
+	"bp_json_cors":  false, // bp.json has a CORS header
+	"claimed":       false, // has called bpclaim within the window
+	"votes":         false, // has any votes
+	"api":           false, // an api endpoint in bp.json answers get_info
+	"api_tls":       false, // ssl endpoints in bp.json have valid certificates
+	"p2p":           false, // a p2p endpoint in bp.json accepts connections
+	"net_api":       false, // the net api is not public, use a penalty
+	"prod_api":      false, // the producer api is not public, use a penalty
+}
+
+// DefaultPolicy is the policy that has always been used by fio-bp-vote. The nodes in bp.json are still probed and
+// saved in ranks.json, but scoring them (api, api_tls, p2p, net_api and prod_api) would change the rankings, so
+// those criteria have to be added with a policy file.
+func DefaultPolicy() *Policy {
+	const day, month = 24 * time.Hour, 30 * 24 * time.Hour
+	return &Policy{
+		Name:        "default",
+		Description: "rewards msig participation and fee votes, penalizes producers that don't claim or have no votes",
+		Criteria: map[string]Criterion{
+			"msig":          {Weight: 10, Window: month},
+			"fee_vote":      {Weight: 2, Cap: 60, Window: month},
+			"compute":       {Weight: 1, Cap: 8, Window: day},
+			"bpclaim":       {Weight: 1, Window: day},
+			"tpidclaim":     {Weight: 0, Window: day},
+			"burnexpired":   {Weight: 1, Window: day},
+			"cpu":           {Weight: 1},
+			"diff_sign_key": {Weight: 1},
+			"linked_auth":   {Weight: 3},
+			"valid_url":     {Weight: 1},
+			"bp_json":       {Weight: 1},
+			"bp_json_cors":  {Weight: 1},
+			"claimed":       {Window: month, Penalty: 100},
+			"votes":         {Penalty: 200},
+		},
+	}
+}
+
+// Scoring is the policy used by RankProducers
+var Scoring = DefaultPolicy()
+
+// LoadPolicy reads a policy file. Criteria that aren't in the file aren't scored, but actions are still counted
+// over the default windows so they show in ranks.json.
+func LoadPolicy(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err = yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if err = p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if p.Name == "" {
+		p.Name = file
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	if len(p.Criteria) == 0 {
+		return errors.New("policy has no criteria")
+	}
+	for name, c := range p.Criteria {
+		counted, ok := criteria[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("unknown criterion '%s', one of: %s", name, strings.Join(criteriaNames(), ", "))
+		case c.Cap < 0 || c.Penalty < 0 || c.Window < 0:
+			return fmt.Errorf("%s: cap, penalty and window cannot be negative", name)
+		case counted && c.Window == 0:
+			return fmt.Errorf("%s: a window is required for counting actions", name)
+		case !counted && name != "claimed" && c.Window != 0:
+			return fmt.Errorf("%s: window only applies to counted actions and claimed", name)
+		case name == "claimed" && c.Window == 0 && c.Penalty != 0:
+			return errors.New("claimed: a window is required")
+		case name == "cpu" && (c.Cap != 0 || c.Penalty != 0):
+			return errors.New("cpu: the cpu score is already a penalty, only weight can be set")
+		}
+	}
+	return nil
+}
+
+func criteriaNames() []string {
+	names := make([]string, 0, len(criteria))
+	for k := range criteria {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// window is how far back to count actions for a criterion, using the default if the policy doesn't have it
+func (p *Policy) window(name string) time.Duration {
+	if c, ok := p.Criteria[name]; ok && c.Window > 0 {
+		return c.Window
+	}
+	return DefaultPolicy().Criteria[name].Window
+}
+
+// maxWindow is the longest window, actions older than this aren't needed
+func (p *Policy) maxWindow() time.Duration {
+	var longest time.Duration
+	for name, counted := range criteria {
+		if w := p.window(name); counted && w > longest {
+			longest = w
+		}
+	}
+	return longest
+}
+
+// ScoreItem is one line of a producer's score, saved in ranks.json so producers can see why they ranked where they
+// did. Exclusions are listed with no points and the reason in the note.
+type ScoreItem struct {
+	Criterion string `json:"criterion"`
+	Value     int    `json:"value"` // actions counted, 1 or 0 for a check, or the cpu score
+	Weight    int    `json:"weight"`
+	Points    int    `json:"points"`
+	Note      string `json:"note,omitempty"`
+}
+
+// item scores a single criterion with the details of how the points were arrived at, count is the number of actions
+// or 1 if a check passed
+func (p *Policy) item(name string, count int) ScoreItem {
+	c, ok := p.Criteria[name]
+	if !ok {
+		return ScoreItem{Criterion: name, Value: count, Note: "not in the policy"}
+	}
+	i := ScoreItem{Criterion: name, Value: count, Weight: c.Weight}
+	if count == 0 && c.Penalty > 0 {
+		i.Points, i.Note = -c.Penalty, "penalty"
+		return i
+	}
+	i.Points = count * c.Weight
+	if c.Cap > 0 && i.Points > c.Cap {
+		i.Points, i.Note = c.Cap, fmt.Sprintf("capped at %d", c.Cap)
+	}
+	return i
+}
@@ -0,0 +1,89 @@
+package voter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	if err := DefaultPolicy().validate(); err != nil {
+		t.Fatal(err)
+	}
+	bp := &BpRank{
+		bpPubKey:          "FIOkey1",
+		bpSignKey:         "FIOkey2",
+		UsingLinkedOrMsig: true,
+		BpJson:            true,
+		RegValidUrl:       true,
+		FeeVote:           40,
+		Msig:              2,
+		BpClaim:           1,
+		TpidClaim:         5,
+		Burn:              3,
+		Compute:           12,
+		CpuScore:          -6,
+		HasClaimed:        true,
+	}
+	bp.score(DefaultPolicy())
+	// 1 sign key + 3 linked + 2 (bp.json, url) + 60 fee votes (capped) + 20 msig + 1 bpclaim + 3 burn + 8 compute - 6 cpu
+	if bp.Score != 92 {
+		t.Errorf("expected 92, got %d", bp.Score)
+	}
+	bp.HasClaimed, bp.hasNoVotes = false, true
+	bp.score(DefaultPolicy())
+	if bp.Score != 92-300 {
+		t.Errorf("expected %d, got %d", 92-300, bp.Score)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(body string) string {
+		f := filepath.Join(dir, "policy.yml")
+		if err := ioutil.WriteFile(f, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	p, err := LoadPolicy(write(`
+name: infrastructure
+criteria:
+  bp_json: {weight: 5}
+  msig: {weight: 1, cap: 5, window: 168h}
+  claimed: {window: 72h, penalty: 50}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := &BpRank{bpPubKey: "a", bpSignKey: "a", BpJson: true, Msig: 9, FeeVote: 30}
+	bp.score(p)
+	if bp.Score != 5+5-50 {
+		t.Errorf("expected %d, got %d", 5+5-50, bp.Score)
+	}
+	if p.window("msig") != 168*time.Hour || p.window("fee_vote") != DefaultPolicy().Criteria["fee_vote"].Window {
+		t.Error("unexpected windows", p.window("msig"), p.window("fee_vote"))
+	}
+
+	for body, want := range map[string]string{
+		`criteria: {uptime: {weight: 1}}`:              "unknown criterion",
+		`criteria: {msig: {weight: 1}}`:                "window is required",
+		`criteria: {bp_json: {weight: 1, window: 1h}}`: "window only applies",
+		`criteria: {cpu: {penalty: 5}}`:                "only weight",
+		`criteria: {votes: {penalty: -5}}`:             "cannot be negative",
+		`name: empty`:                                  "no criteria",
+		`criteria: {msig: {weight: 1, windw: 1h}}`:     "windw",
+	} {
+		if _, err = LoadPolicy(write(body)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected '%s', got %v", body, want, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package voter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// infrastructure is what was found probing the nodes listed in a producer's bp.json
+type infrastructure struct {
+	apiAvail   bool      // an api or ssl endpoint answered get_info for this chain
+	apiTls     bool      // every ssl endpoint has a valid certificate that isn't about to expire
+	tlsExpires time.Time // the earliest certificate expiration
+	p2pAvail   bool      // a p2p endpoint accepted a connection
+	netApi     bool      // /v1/net is public on an api endpoint
+	prodApi    bool      // /v1/producer is public on an api endpoint
+}
+
+// prober checks the nodes from bp.json. Like fio-go's GetBpJson, endpoints that resolve to a private address are
+// skipped, these are published by the producer and we don't want to be used to reach into a network. The address is
+// checked when connecting, after it's resolved, so redirects and names that resolve differently the second time
+// don't get around it.
+type prober struct {
+	client       *http.Client
+	roots        *x509.CertPool // nil uses the system roots
+	timeout      time.Duration
+	expiring     time.Duration // a certificate expiring sooner than this is treated as invalid
+	allowPrivate bool          // tests use local servers
+}
+
+func newProber() *prober {
+	p := &prober{
+		timeout:  5 * time.Second,
+		expiring: 14 * 24 * time.Hour,
+	}
+	p.client = &http.Client{
+		Timeout: p.timeout,
+		Transport: &http.Transport{
+			DialContext:         p.dialer().DialContext,
+			TLSHandshakeTimeout: p.timeout,
+		},
+	}
+	return p
+}
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// dialer refuses connections to private addresses
+func (p *prober) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: p.timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if p.allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || private(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+}
+
+// probe checks every endpoint concurrently
+func (p *prober) probe(nodes []fio.BpJsonNode, chainId string) *infrastructure {
+	result := &infrastructure{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	var sslEndpoints, sslValid int
+	check := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	for _, node := range nodes {
+		for _, endpoint := range []string{node.ApiEndpoint, node.SslEndpoint} {
+			if endpoint == "" {
+				continue
+			}
+			endpoint := strings.TrimRight(endpoint, "/")
+			check(func() {
+				avail, netApi, prodApi := p.api(endpoint, chainId)
+				mux.Lock()
+				defer mux.Unlock()
+				result.apiAvail = result.apiAvail || avail
+				result.netApi = result.netApi || netApi
+				result.prodApi = result.prodApi || prodApi
+			})
+		}
+		if node.SslEndpoint != "" {
+			sslEndpoints += 1
+			endpoint := node.SslEndpoint
+			check(func() {
+				expires, err := p.tls(endpoint)
+				mux.Lock()
+				defer mux.Unlock()
+				if !expires.IsZero() && (result.tlsExpires.IsZero() || expires.Before(result.tlsExpires)) {
+					result.tlsExpires = expires
+				}
+				if err == nil {
+					sslValid += 1
+				} else if V {
+					log.Println(endpoint, err)
+				}
+			})
+		}
+		if node.P2pEndpoint != "" {
+			endpoint := node.P2pEndpoint
+			check(func() {
+				ok := p.p2p(endpoint)
+				mux.Lock()
+				defer mux.Unlock()
+				result.p2pAvail = result.p2pAvail || ok
+			})
+		}
+	}
+	wg.Wait()
+	result.apiTls = sslEndpoints > 0 && sslValid == sslEndpoints
+	return result
+}
+
+// api returns if get_info works and the chain id matches, and if the net and producer apis are exposed
+func (p *prober) api(endpoint string, chainId string) (avail bool, netApi bool, prodApi bool) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+	post := func(path string) ([]byte, bool) {
+		resp, err := p.client.Post(endpoint+path, "application/json", bytes.NewReader([]byte("{}")))
+		if err != nil {
+			return nil, false
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return body, err == nil && resp.StatusCode == http.StatusOK
+	}
+	if body, ok := post("/v1/chain/get_info"); ok {
+		info := struct {
+			ChainId string `json:"chain_id"`
+		}{}
+		avail = json.Unmarshal(body, &info) == nil && info.ChainId != "" && (chainId == "" || info.ChainId == chainId)
+	}
+	_, netApi = post("/v1/net/connections")
+	_, prodApi = post("/v1/producer/paused")
+	return
+}
+
+// tls verifies the certificate for an ssl endpoint, returning when it expires
+func (p *prober) tls(endpoint string) (time.Time, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if u.Scheme != "https" {
+		return time.Time{}, errors.New("ssl endpoint is not https")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	conn, err := tls.DialWithDialer(p.dialer(), "tcp", net.JoinHostPort(u.Hostname(), port),
+		&tls.Config{RootCAs: p.roots, ServerName: u.Hostname()})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return time.Time{}, errors.New("no certificate")
+	}
+	expires := certs[0].NotAfter
+	if time.Until(expires) < p.expiring {
+		return expires, fmt.Errorf("certificate expires %s", expires.Format(time.RFC3339))
+	}
+	return expires, nil
+}
+
+// p2p only checks that a connection can be made, there's no handshake
+func (p *prober) p2p(endpoint string) bool {
+	conn, err := p.dialer().Dial("tcp", endpoint)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func private(ip net.IP) bool {
+	for _, block := range privateBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateBlocks are the ranges fio-go refuses when fetching bp.json, and unspecified addresses
+var privateBlocks = func() []*net.IPNet {
+	blocks := make([]*net.IPNet, 0)
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "::/128", "::1/128", "fe80::/10", "fc00::/7",
+		"fec0::/10", "2001:db8::/32",
+	} {
+		_, block, _ := net.ParseCIDR(cidr)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}()
@@ -0,0 +1,123 @@
+package voter
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nodeApi answers get_info for a chain, and optionally the net and producer apis
+func nodeApi(chainId string, exposed ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chain/get_info", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"chain_id":"%s","head_block_num":1}`, chainId)
+	})
+	for _, path := range exposed {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[]`))
+		})
+	}
+	return mux
+}
+
+func TestProbe(t *testing.T) {
+	const chainId = "21dcae42c0182200e93f954a074011f9048a7624c6fe81d3c9541a614a88bd1c"
+
+	api := httptest.NewServer(nodeApi(chainId, "/v1/net/connections"))
+	defer api.Close()
+	ssl := httptest.NewTLSServer(nodeApi(chainId, "/v1/producer/paused"))
+	defer ssl.Close()
+	other := httptest.NewServer(nodeApi("not this chain"))
+	defer other.Close()
+	p2p, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p2p.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ssl.Certificate())
+	p := &prober{
+		client:       ssl.Client(),
+		roots:        roots,
+		timeout:      time.Second,
+		expiring:     14 * 24 * time.Hour,
+		allowPrivate: true,
+	}
+
+	nodes := []fio.BpJsonNode{
+		{ApiEndpoint: api.URL, P2pEndpoint: closedAddr},
+		{SslEndpoint: ssl.URL, P2pEndpoint: p2p.Addr().String()},
+	}
+	infra := p.probe(nodes, chainId)
+	if !infra.apiAvail || !infra.apiTls || !infra.p2pAvail || !infra.netApi || !infra.prodApi {
+		t.Errorf("expected everything to be found, got %+v", infra)
+	}
+	if !infra.tlsExpires.Equal(ssl.Certificate().NotAfter) {
+		t.Error("expected the certificate expiration, got", infra.tlsExpires)
+	}
+
+	// wrong chain, nothing exposed, and nothing listening for p2p
+	infra = p.probe([]fio.BpJsonNode{{ApiEndpoint: other.URL + "/", P2pEndpoint: closedAddr}}, chainId)
+	if infra.apiAvail || infra.apiTls || infra.p2pAvail || infra.netApi || infra.prodApi {
+		t.Errorf("expected nothing to be found, got %+v", infra)
+	}
+
+	// certificates that can't be verified or are about to expire fail the tls check, the api still works
+	untrusted := &prober{client: ssl.Client(), timeout: time.Second, expiring: time.Hour, allowPrivate: true}
+	if infra = untrusted.probe([]fio.BpJsonNode{{SslEndpoint: ssl.URL}}, chainId); infra.apiTls || !infra.apiAvail {
+		t.Errorf("an untrusted certificate should not pass, got %+v", infra)
+	}
+	p.expiring = time.Until(ssl.Certificate().NotAfter) + time.Hour
+	if infra = p.probe(nodes, chainId); infra.apiTls {
+		t.Error("an expiring certificate should not pass")
+	}
+	if _, err = p.tls(strings.Replace(ssl.URL, "https", "http", 1)); err == nil {
+		t.Error("expected an http ssl endpoint to fail")
+	}
+
+	// local addresses are refused outside of tests, checked when connecting so redirects can't get around it
+	guarded := newProber()
+	if infra = guarded.probe(nodes, chainId); infra.apiAvail || infra.p2pAvail {
+		t.Errorf("a private address should not be probed, got %+v", infra)
+	}
+	if _, err = guarded.tls(ssl.URL); err == nil || !strings.Contains(err.Error(), errPrivateAddress.Error()) {
+		t.Error("expected the tls check to refuse a private address, got", err)
+	}
+	if _, err = guarded.client.Get(api.URL); err == nil || !strings.Contains(err.Error(), errPrivateAddress.Error()) {
+		t.Error("expected the client to refuse a private address, got", err)
+	}
+
+	// infrastructure is only scored when the policy asks for it
+	bp := &BpRank{nodes: nodes, HasClaimed: true}
+	bp.score(DefaultPolicy())
+	unprobed := bp.Score
+	bp.probe(p, chainId)
+	if bp.score(DefaultPolicy()); bp.Score != unprobed {
+		t.Errorf("the default policy should not score infrastructure, %d became %d", unprobed, bp.Score)
+	}
+	infraPolicy := &Policy{Criteria: map[string]Criterion{
+		"api":      {Weight: 1},
+		"api_tls":  {Weight: 1},
+		"p2p":      {Weight: 1},
+		"net_api":  {Penalty: 5},
+		"prod_api": {Penalty: 20},
+	}}
+	if err = infraPolicy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	bp.score(infraPolicy)
+	// +1 api +1 p2p, -5 net api -20 producer api
+	if bp.Score != 2-25 || !bp.ApiAvail || bp.ApiTls || bp.ApiTlsExpires == "" {
+		t.Errorf("unexpected score %d: %+v", bp.Score, bp)
+	}
+}
@@ -0,0 +1,174 @@
+package voter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"log"
+	"strings"
+)
+
+// Proxy registers the actor as a voting proxy before voting, the votes then carry the weight of every account that
+// proxies to it.
+var Proxy bool
+
+// UnRegProxy is missing from fio-go, it has the same fields as RegProxy.
+type UnRegProxy struct {
+	FioAddress string          `json:"fio_address"`
+	Actor      eos.AccountName `json:"actor"`
+	MaxFee     uint64          `json:"max_fee"`
+}
+
+// VoterInfo is a row from the voters table
+type VoterInfo struct {
+	Owner     eos.AccountName `json:"owner"`
+	Proxy     eos.AccountName `json:"proxy"`
+	Producers []string        `json:"producers"`
+	IsProxy   byte            `json:"is_proxy"`
+}
+
+type tableReader interface {
+	GetTableRows(params eos.GetTableRowsRequest) (*eos.GetTableRowsResp, error)
+}
+
+// GetVoterInfo looks up an account in the voters table, it returns nil if the account has never voted
+func GetVoterInfo(api tableReader, account eos.AccountName) (*VoterInfo, error) {
+	gtr, err := api.GetTableRows(eos.GetTableRowsRequest{
+		Code:       "eosio",
+		Scope:      "eosio",
+		Table:      "voters",
+		Index:      "3",
+		LowerBound: string(account),
+		UpperBound: string(account),
+		Limit:      1,
+		KeyType:    "name",
+		JSON:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*VoterInfo, 0)
+	if err = json.Unmarshal(gtr.Rows, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || rows[0] == nil || rows[0].Owner != account {
+		return nil, nil
+	}
+	return rows[0], nil
+}
+
+// proxyAction is an eosio action for the actor, using the configured permission
+func proxyAction(name eos.ActionName, data interface{}) *fio.Action {
+	return fio.NewActionWithPermission("eosio", name,
+		eos.AccountName(strings.Split(Perm, "@")[0]),
+		strings.Split(Perm, "@")[1],
+		data,
+	)
+}
+
+// pushProxyAction prints the action when doing a dry-run, otherwise it is sent.
+func pushProxyAction(api *fio.API, action *fio.Action) error {
+	if Dry {
+		j, err := json.MarshalIndent(action, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println("would have sent:")
+		fmt.Println(string(j))
+		return nil
+	}
+	resp, err := api.SignPushActions(action)
+	if err != nil {
+		return err
+	}
+	if V {
+		log.Printf("%s: %s\n", action.Name, resp.TransactionID)
+	}
+	return nil
+}
+
+// RegisterProxy sends regproxy for the actor if it isn't already a proxy, returning true if it was sent.
+func RegisterProxy(api *fio.API) (bool, error) {
+	info, err := GetVoterInfo(api, eos.AccountName(Actor))
+	if err != nil {
+		return false, err
+	}
+	if info != nil && info.IsProxy == 1 {
+		if V {
+			log.Println(Actor, "is already registered as a proxy")
+		}
+		return false, nil
+	}
+	if info != nil && info.Proxy != "" {
+		return false, fmt.Errorf("%s is proxying its votes to %s, it can't also be a proxy", Actor, info.Proxy)
+	}
+	api.RefreshFees()
+	log.Println("registering", Address, "as a voting proxy")
+	err = pushProxyAction(api, proxyAction("regproxy", fio.RegProxy{
+		FioAddress: Address,
+		Actor:      eos.AccountName(Actor),
+		MaxFee:     fio.Tokens(fio.GetMaxFee(fio.FeeRegisterProxy)),
+	}))
+	return err == nil, err
+}
+
+// UnregisterProxy sends unregproxy for the actor, accounts proxying to it will no longer have their votes counted.
+func UnregisterProxy(api *fio.API) error {
+	info, err := GetVoterInfo(api, eos.AccountName(Actor))
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsProxy != 1 {
+		return fmt.Errorf("%s is not registered as a proxy", Actor)
+	}
+	api.RefreshFees()
+	log.Println("unregistering", Address, "as a voting proxy")
+	return pushProxyAction(api, proxyAction("unregproxy", UnRegProxy{
+		FioAddress: Address,
+		Actor:      eos.AccountName(Actor),
+		MaxFee:     fio.Tokens(fio.GetMaxFee(fio.FeeUnregisterProxy)),
+	}))
+}
+
+// FollowProxy delegates the actor's votes to a proxy, identified by its FIO address.
+func FollowProxy(api *fio.API, proxy string) error {
+	if !fio.Address(proxy).Valid() {
+		return errors.New(proxy + " is not a valid fio address")
+	}
+	pa, ok, err := api.PubAddressLookup(fio.Address(proxy), "FIO", "FIO")
+	if err != nil || !ok {
+		return fmt.Errorf("could not find the account for %s: %v", proxy, err)
+	}
+	account, err := fio.ActorFromPub(pa.PublicAddress)
+	if err != nil {
+		return err
+	}
+	if string(account) == Actor {
+		return errors.New("cannot proxy votes to ourselves")
+	}
+	target, err := GetVoterInfo(api, account)
+	if err != nil {
+		return err
+	}
+	if target == nil || target.IsProxy != 1 {
+		return fmt.Errorf("%s (%s) is not registered as a proxy", proxy, account)
+	}
+	info, err := GetVoterInfo(api, eos.AccountName(Actor))
+	if err != nil {
+		return err
+	}
+	if info != nil && info.Proxy == account {
+		log.Println(Actor, "is already proxying votes to", proxy)
+		return nil
+	}
+	api.RefreshFees()
+	log.Println("proxying votes for", Actor, "to", proxy)
+	return pushProxyAction(api, proxyAction("voteproxy", fio.VoteProxy{
+		Proxy:      proxy,
+		FioAddress: Address,
+		Actor:      eos.AccountName(Actor),
+		MaxFee:     fio.Tokens(fio.GetMaxFee(fio.FeeProxyVote)),
+	}))
+}
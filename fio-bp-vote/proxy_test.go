@@ -0,0 +1,42 @@
+package voter
+
+import (
+	"github.com/fioprotocol/fio-go"
+	"github.com/fioprotocol/fio-go/eos"
+	"testing"
+)
+
+type fakeVoters string
+
+func (f fakeVoters) GetTableRows(params eos.GetTableRowsRequest) (*eos.GetTableRowsResp, error) {
+	return &eos.GetTableRowsResp{Rows: []byte(f)}, nil
+}
+
+func TestGetVoterInfo(t *testing.T) {
+	rows := fakeVoters(`[{"id":7,"fioaddress":"proxy@dapixdev","addresshash":"0x0","owner":"qbxn5zhw2ypw","proxy":"",` +
+		`"producers":["aqpivvmyhwr2"],"last_vote_weight":"100.0","proxied_vote_weight":"0.0","is_proxy":1,"is_auto_proxy":0}]`)
+	info, err := GetVoterInfo(rows, "qbxn5zhw2ypw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.IsProxy != 1 || len(info.Producers) != 1 {
+		t.Errorf("unexpected voter info %+v", info)
+	}
+	// the table is read with a bound, a different owner means the account hasn't voted
+	if info, err = GetVoterInfo(rows, "htjonrkf1lgs"); err != nil || info != nil {
+		t.Error("expected no row, got", info, err)
+	}
+	if info, err = GetVoterInfo(fakeVoters(`[]`), "qbxn5zhw2ypw"); err != nil || info != nil {
+		t.Error("expected no row, got", info, err)
+	}
+}
+
+func TestProxyAction(t *testing.T) {
+	Perm = "qbxn5zhw2ypw@vote"
+	defer func() { Perm = "" }()
+	a := proxyAction("regproxy", fio.RegProxy{FioAddress: "proxy@dapixdev", Actor: "qbxn5zhw2ypw"})
+	if a.Name != "regproxy" || len(a.Authorization) != 1 ||
+		a.Authorization[0].Actor != "qbxn5zhw2ypw" || a.Authorization[0].Permission != "vote" {
+		t.Errorf("unexpected action %+v", a)
+	}
+}
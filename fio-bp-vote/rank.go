@@ -17,22 +17,21 @@ import (
 	"time"
 )
 
-const (
-	thirty  uint32 = 30 * 24 * 60 * 120
-	one     uint32 = 24 * 60 * 120
-	highCpu uint64 = 7_000
-)
+const highCpu uint64 = 7_000
 
-func RankProducers(eligible []string, cpuRank map[string]int, api *fio.API) ([]string, error) {
+// RankProducers scores and sorts the eligible producers. Producers with no votes that have not claimed are dropped,
+// ranks.json lists them and the excluded producers from getEligible with the reason they won't get a vote.
+func RankProducers(eligible []string, excluded map[string]string, cpuRank map[string]int, api *fio.API) ([]string, error) {
 	if V {
-		log.Println("ranking producers ...")
+		log.Printf("ranking producers using the %s policy ...", Scoring.Name)
 	}
 	var err error
 	bps := make(map[string]*BpRank)
-	_, err = api.GetInfo()
+	gi, err := api.GetInfo()
 	if err != nil {
 		return nil, err
 	}
+	infra := newProber()
 	for _, bp := range eligible {
 		if pa, ok, _ := api.PubAddressLookup(fio.Address(bp), "FIO", "FIO"); ok {
 			bps[bp] = &BpRank{Address: fio.Address(bp), CpuScore: cpuRank[bp]}
@@ -41,7 +40,7 @@ func RankProducers(eligible []string, cpuRank map[string]int, api *fio.API) ([]s
 			if err != nil {
 				continue
 			}
-			err = bps[bp].getHistory(api)
+			err = bps[bp].getHistory(api, Scoring)
 			if err != nil && V {
 				log.Println(err)
 			}
@@ -54,11 +53,12 @@ func RankProducers(eligible []string, cpuRank map[string]int, api *fio.API) ([]s
 		// getting bp.json is slow, do it concurrently
 		go func(bp *BpRank, who string) {
 			defer wg.Done()
-			err = bp.getBpJson(api)
+			err := bp.getBpJson(api, infra, gi.ChainID.String())
 			if err != nil && V {
 				log.Println(who, err)
 			}
-			bp.score()
+			bp.probe(infra, gi.ChainID.String())
+			bp.score(Scoring)
 		}(b, string(b.Address))
 	}
 	wg.Wait()
@@ -67,6 +67,22 @@ func RankProducers(eligible []string, cpuRank map[string]int, api *fio.API) ([]s
 		return nil, errors.New("eligible voter slice was nil")
 	}
 
+	if excluded == nil {
+		excluded = make(map[string]string)
+	}
+	ranked := make([]string, 0, len(eligible))
+	for _, bpr := range eligible {
+		if bps[bpr] != nil && bps[bpr].hasNoVotes && !bps[bpr].HasClaimed {
+			excluded[bpr] = "has no votes and has not claimed in " + shortDuration(Scoring.window("claimed"))
+			continue
+		}
+		ranked = append(ranked, bpr)
+	}
+	if len(ranked) == 0 {
+		return nil, errors.New("no eligible producers")
+	}
+	eligible = ranked
+
 	sort.Slice(eligible, func(i, j int) bool {
 		if bps == nil || bps[eligible[i]] == nil || bps[eligible[j]] == nil {
 			return false
@@ -78,19 +94,41 @@ func RankProducers(eligible []string, cpuRank map[string]int, api *fio.API) ([]s
 	func() {
 		r := make([]*BpRank, 0)
 		for _, bpr := range eligible {
-			if bps[bpr] == nil || bps[bpr].hasNoVotes && !bps[bpr].HasClaimed {
+			if bps[bpr] == nil {
 				continue
 			}
 			r = append(r, bps[bpr])
 		}
 		for k, v := range Missed {
 			if v.After(time.Now().UTC()) {
+				reason := "missed a round, excluded until " + v.UTC().Format(time.RFC3339)
 				r = append(r, &BpRank{
 					Address:         fio.Address(k),
 					MissingExcluded: true,
+					Excluded:        reason,
+					Explain:         []ScoreItem{{Criterion: "missed_round", Note: reason}},
 				})
 			}
 		}
+		names := make([]string, 0, len(excluded))
+		for k := range excluded {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			if until, missed := Missed[k]; missed && until.After(time.Now().UTC()) || k == "" {
+				continue
+			}
+			rank := &BpRank{Address: fio.Address(k), Excluded: excluded[k]}
+			if bps[k] != nil {
+				// scored, but dropped afterward
+				rank = bps[k]
+				rank.Excluded = excluded[k]
+			}
+			rank.Explain = append(rank.Explain, ScoreItem{Criterion: "excluded", Note: excluded[k]})
+			r = append(r, rank)
+		}
+		lastRanks = r
 		j, err := json.MarshalIndent(r, "", "  ")
 		if err != nil {
 			log.Println(err)
@@ -123,60 +161,98 @@ type BpRank struct {
 	Burn      int `json:"burnexpired_1d"`
 	CpuScore  int `json:"cpu_score"`
 
+	// from probing the nodes in bp.json
+	ApiAvail      bool   `json:"api_avail"`
+	ApiTls        bool   `json:"api_tls"`
+	ApiTlsExpires string `json:"api_tls_expires,omitempty"`
+	P2pAvail      bool   `json:"p2p_avail"`
+	NetApi        bool   `json:"net_api"`
+	ProdApi       bool   `json:"prod_api"`
+	nodes         []fio.BpJsonNode
+
 	// TODO: even more info
 	//Monitor      bool `json:"monitor"`
-	//ApiAvail     bool `json:"api_avail"`
-	//ApiTls       bool `json:"api_tls"`
-	//P2pAvail     bool `json:"p2p_avail"`
-	//NetApi       bool `json:"net_api"`
-	//ProdApi      bool `json:"prod_api"`
 	//MissedBlocks int  `json:"missed_blocks"`
-	MissingExcluded bool `json:"missing_excluded"`
+	MissingExcluded bool   `json:"missing_excluded"`
+	Excluded        string `json:"excluded,omitempty"` // why the producer won't get a vote
 
 	DiffSignKey       bool `json:"diff_sign_key"`
 	BpJson            bool `json:"bp_json"`
 	BpJsonCors        bool `json:"bp_json_cors"`
+	BpJsonComplete    int  `json:"bp_json_complete"` // percent of the bp.json checks that passed
 	RegValidUrl       bool `json:"valid_url"`
 	UsingLinkedOrMsig bool `json:"using_linked_auth_or_msig"`
 	HasClaimed        bool `json:"has_claimed_30d"`
 	hasNoVotes        bool
-	Svg               string `json:"svg"`
-	Time              string `json:"time"`
+	Svg               string      `json:"svg"`
+	Time              string      `json:"time"`
+	Explain           []ScoreItem `json:"explain"`
+	BpJsonErrors      []string    `json:"bp_json_errors,omitempty"`
 }
 
-func (bp *BpRank) score() {
-	bp.Score = 0
-	if bp.bpPubKey != bp.bpSignKey {
-		bp.DiffSignKey = true
-		bp.Score += 1
+// shortDuration prints whole days as days, 720h is easier to read as 30d
+func shortDuration(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
 	}
-	if bp.UsingLinkedOrMsig {
-		bp.Score += 3
-	}
-	for _, good := range []bool{bp.BpJson, bp.BpJsonCors, bp.RegValidUrl} {
-		if good {
-			bp.Score += 1
+	return d.String()
+}
+
+func (bp *BpRank) score(p *Policy) {
+	bp.DiffSignKey = bp.bpPubKey != bp.bpSignKey
+	counts := map[string]int{
+		"msig":        bp.Msig,
+		"fee_vote":    bp.FeeVote,
+		"compute":     bp.Compute,
+		"bpclaim":     bp.BpClaim,
+		"tpidclaim":   bp.TpidClaim,
+		"burnexpired": bp.Burn,
+		"cpu":         bp.CpuScore,
+	}
+	checks := map[string]bool{
+		"diff_sign_key": bp.DiffSignKey,
+		"linked_auth":   bp.UsingLinkedOrMsig,
+		"valid_url":     bp.RegValidUrl,
+		"bp_json":       bp.BpJson,
+		"bp_json_cors":  bp.BpJsonCors,
+		"claimed":       bp.HasClaimed,
+		"votes":         !bp.hasNoVotes,
+		"api":           bp.ApiAvail,
+		"api_tls":       bp.ApiTls,
+		"p2p":           bp.P2pAvail,
+		"net_api":       !bp.NetApi,
+		"prod_api":      !bp.ProdApi,
+	}
+	for name, ok := range checks {
+		if ok {
+			counts[name] = 1
 		}
 	}
-	// gets a boost, but only so much, calling it every few minutes is a waste.
-	feeScore := bp.FeeVote * 2
-	if feeScore > 60 {
-		feeScore = 60
-	}
-	//  extra rewards for msig, and feevoting
-	bp.Score += (10 * bp.Msig) + feeScore + bp.BpClaim + bp.Burn + bp.CpuScore + bp.Compute
-	// looks like no one is home, knock the score way down!
-	if !bp.HasClaimed {
-		bp.Score -= 100
+	names := make([]string, 0, len(p.Criteria))
+	for name := range p.Criteria {
+		names = append(names, name)
 	}
-	// producers without any votes are even less desirable
-	if bp.hasNoVotes {
-		bp.Score -= 200
+	sort.Strings(names)
+	bp.Score = 0
+	bp.Explain = make([]ScoreItem, 0, len(names))
+	for _, name := range names {
+		item := p.item(name, counts[name])
+		switch {
+		case name == "cpu" && bp.CpuScore < 0:
+			item.Note = fmt.Sprintf("average transaction cpu over %dµs", highCpu)
+		case criteria[name] && item.Note == "":
+			item.Note = "last " + shortDuration(p.window(name))
+		}
+		bp.Score += item.Points
+		bp.Explain = append(bp.Explain, item)
 	}
 	bp.Time = time.Now().Format(time.UnixDate)
 }
 
-func (bp *BpRank) getBpJson(api *fio.API) error {
+// getBpJson loads and validates bp.json. chains.json and the CORS check are requested with the prober's client, both
+// are on a host the producer chose.
+func (bp *BpRank) getBpJson(api *fio.API, p *prober, chainId string) error {
 	if bp.Account == "" {
 		return errors.New("cannot search: bp.Account is empty")
 	}
@@ -188,10 +264,14 @@ func (bp *BpRank) getBpJson(api *fio.API) error {
 	bp.Svg = bpj.Org.Branding.LogoSvg
 	if bpj.Nodes != nil && len(bpj.Nodes) > 0 {
 		bp.BpJson = true
+		bp.nodes = bpj.Nodes
 	}
 
+	report := validateBpJson(bpj, string(bp.Account))
+	report.checkChains(p.client, bpj.BpJsonUrl, chainId)
+	bp.BpJsonComplete, bp.BpJsonErrors = report.complete(), report.problems
+
 	// Correctly add an Origin header on this request, not all servers return CORS headers unless asked for them.
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", bpj.BpJsonUrl, nil)
 	if err != nil {
 		return err
@@ -205,7 +285,8 @@ func (bp *BpRank) getBpJson(api *fio.API) error {
 	//if origin == "https://blockpane.com" {
 	//	fmt.Printf("%s REQUEST -- %+v\n", origin, req.Header)
 	//}
-	if resp, err := client.Do(req); err == nil && resp != nil {
+	if resp, err := p.client.Do(req); err == nil && resp != nil {
+		_ = resp.Body.Close()
 		//if origin == "https://blockpane.com" {
 		//	fmt.Printf("%s -- %+v\n", origin, resp.Header)
 		//}
@@ -216,7 +297,20 @@ func (bp *BpRank) getBpJson(api *fio.API) error {
 	return nil
 }
 
-func (bp *BpRank) getHistory(api *fio.API) error {
+// probe checks the nodes listed in bp.json, if there was one
+func (bp *BpRank) probe(p *prober, chainId string) {
+	if len(bp.nodes) == 0 {
+		return
+	}
+	infra := p.probe(bp.nodes, chainId)
+	bp.ApiAvail, bp.ApiTls, bp.P2pAvail = infra.apiAvail, infra.apiTls, infra.p2pAvail
+	bp.NetApi, bp.ProdApi = infra.netApi, infra.prodApi
+	if !infra.tlsExpires.IsZero() {
+		bp.ApiTlsExpires = infra.tlsExpires.UTC().Format(time.RFC3339)
+	}
+}
+
+func (bp *BpRank) getHistory(api *fio.API, p *Policy) error {
 	_, bpc, err := GetProducerCompact(bp.Account, api)
 	if err != nil || bpc == nil {
 		if V {
@@ -225,7 +319,8 @@ func (bp *BpRank) getHistory(api *fio.API) error {
 		return err
 	}
 	bp.bpSignKey = bpc.ProducerPublicKey
-	if bpc.LastBpClaim > time.Now().UTC().Add(-720*time.Hour).Unix() {
+	now := time.Now().UTC()
+	if bpc.LastBpClaim > now.Add(-p.window("claimed")).Unix() {
 		bp.HasClaimed = true
 	}
 	if bpc.TotalVotes == "0.00000000000000000" {
@@ -238,19 +333,10 @@ func (bp *BpRank) getHistory(api *fio.API) error {
 	if highest == 0 {
 		return nil
 	}
-	gi, err := api.GetInfo()
-	if err != nil {
-		if V {
-			log.Println(err)
-		}
-		return err
-	}
-	var thirtyDays, oneDay uint32 = 0, 0
-	if thirty < gi.HeadBlockNum {
-		thirtyDays = gi.HeadBlockNum - thirty
-	}
-	if one < gi.HeadBlockNum {
-		oneDay = gi.HeadBlockNum - one
+	// only count actions within the window for each criterion
+	oldest := now.Add(-p.maxWindow())
+	within := func(name string, t time.Time) bool {
+		return t.After(now.Add(-p.window(name)))
 	}
 	//dups := make(map[string]bool)
 	for i := int64(highest); i > 0; i -= 100 {
@@ -266,11 +352,12 @@ func (bp *BpRank) getHistory(api *fio.API) error {
 		if err != nil {
 			return nil
 		}
-		if at == nil || at.Actions == nil || len(at.Actions) == 0 || at.Actions[len(at.Actions)-1].BlockNum < thirtyDays {
+		if at == nil || at.Actions == nil || len(at.Actions) == 0 || at.Actions[len(at.Actions)-1].BlockTime.Before(oldest) {
 			break
 		}
 		for i := len(at.Actions) - 1; i >= 0; i-- {
-			if at.Actions[i].BlockTime.Before(time.Now().Add(-time.Duration(24*30) * time.Hour)) {
+			blockTime := at.Actions[i].BlockTime.Time
+			if blockTime.Before(oldest) {
 				break
 			}
 			//if at.Actions[i].Trace.Action == nil || at.Actions[i].Trace.Action.Authorization == nil || dups[at.Actions[i].Trace.TransactionID.String()] {
@@ -288,6 +375,9 @@ func (bp *BpRank) getHistory(api *fio.API) error {
 			if !fromBp {
 				switch act {
 				case "propose", "approve", "exec":
+					if !within("msig", blockTime) {
+						continue
+					}
 					bp.Msig += 1
 					fmt.Println(at.Actions[i].Trace.TransactionID.String(), bp.Address)
 					//dups[at.Actions[i].Trace.TransactionID.String()] = true
@@ -297,25 +387,30 @@ func (bp *BpRank) getHistory(api *fio.API) error {
 			switch act {
 			// bundlevote should no longer work, but leaving it for now.
 			case "bundlevote", "setfeemult", "setfeevote", "mandatoryfee":
-				bp.FeeVote += 1
+				if within("fee_vote", blockTime) {
+					bp.FeeVote += 1
+				}
 			case "computefees":
-				// limit boost for calling computefees since it's free
-				if at.Actions[i].BlockNum >= oneDay && bp.Compute < 8 {
+				// the boost for calling computefees is limited by the policy's cap since it's free
+				if within("compute", blockTime) {
 					bp.Compute += 1
 				}
 			case "bpclaim":
-				if at.Actions[i].BlockNum >= oneDay {
+				if within("bpclaim", blockTime) {
 					bp.BpClaim += 1
 				}
 			case "tpidclaim":
-				if at.Actions[i].BlockNum >= oneDay {
+				if within("tpidclaim", blockTime) {
 					bp.TpidClaim += 1
 				}
 			case "burnexpired":
-				if at.Actions[i].BlockNum >= oneDay {
+				if within("burnexpired", blockTime) {
 					bp.Burn += 1
 				}
 			case "propose", "approve", "exec":
+				if !within("msig", blockTime) {
+					break
+				}
 				bp.Msig += 1
 				fmt.Println(at.Actions[i].Trace.TransactionID.String(), bp.Address)
 			}
@@ -63,7 +63,22 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 		return errors.New("headblock time is > 10 minutes behind")
 	}
 
-	eligible, err := getEligible(api)
+	if Proxy {
+		registered, err := RegisterProxy(api)
+		if err != nil {
+			return err
+		}
+		// a new proxy votes again, even if the ranking hasn't changed
+		if registered {
+			LastVote = ""
+		}
+	}
+
+	eligible, excluded, err := getEligible(api)
+	if err != nil {
+		return err
+	}
+	eligible, err = RankProducers(eligible, excluded, cpuRank, api)
 	if err != nil {
 		return err
 	}
@@ -71,10 +86,6 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 	if votes > NumVotes {
 		votes = NumVotes
 	}
-	eligible, err = RankProducers(eligible, cpuRank, api)
-	if err != nil {
-		return err
-	}
 
 	// since this is a long-running daemon, fees may have changed since last run, ensure it's fresh
 	api.RefreshFees()
@@ -98,6 +109,7 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 		fmt.Println(string(j))
 	}
 
+	voted := append([]string{}, eligible[:votes]...)
 	cur := eligible[:votes]
 	sort.Strings(cur)
 	lv := strings.Join(cur, ",")
@@ -105,6 +117,7 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 		if V {
 			log.Println("no vote changes based on ranking")
 		}
+		saveHistory(voted, VoteUnchanged)
 		return nil
 	}
 	LastVote = lv
@@ -125,6 +138,16 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 			log.Println(string(j))
 		}
 	}
+	switch {
+	case Dry:
+		saveHistory(voted, VoteDryRun)
+	case err != nil:
+		// try again on the next run
+		LastVote = ""
+		saveHistory(voted, VoteFailed)
+	default:
+		saveHistory(voted, VotePushed)
+	}
 	if Dry || (resp != nil && err == nil) {
 		MissedAfter = time.Now().Add(12 * time.Minute)
 		go func() {
@@ -147,6 +170,24 @@ func Vote(cpuRank map[string]int, api *fio.API) error {
 	return err
 }
 
+// saveHistory records the run once the outcome of the vote is known
+func saveHistory(voted []string, status string) {
+	if HistoryFile == "" {
+		return
+	}
+	err := AppendHistory(HistoryFile, &RankRun{
+		Time:   time.Now().UTC(),
+		Policy: Scoring.Name,
+		Dry:    Dry,
+		Status: status,
+		Voted:  voted,
+		Ranks:  historyRanks(lastRanks),
+	})
+	if err != nil {
+		log.Println("could not save rank history:", err)
+	}
+}
+
 func FindMisses(cpuRank map[string]int, api *fio.API) error {
 	if skipMissed {
 		if V {
@@ -248,14 +289,22 @@ func FindMisses(cpuRank map[string]int, api *fio.API) error {
 	return nil
 }
 
-func getEligible(api *fio.API) ([]string, error) {
+// getEligible returns the producers that can be ranked, and why each of the others was left out, by fio address.
+// Producers that missed a round aren't in excluded, RankProducers lists them from Missed.
+func getEligible(api *fio.API) (eligible []string, excluded map[string]string, err error) {
 	gp, err := api.GetFioProducers()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	registered := make(map[string]bool)
+	excluded = make(map[string]string)
 	for _, p := range gp.Producers {
-		if p.IsActive == 0 || p.TotalVotes == `0.00000000000000000` {
+		switch {
+		case p.IsActive == 0:
+			excluded[string(p.FioAddress)] = "inactive in the producers table"
+			continue
+		case p.TotalVotes == `0.00000000000000000`:
+			excluded[string(p.FioAddress)] = "has no votes"
 			continue
 		}
 
@@ -264,34 +313,38 @@ func getEligible(api *fio.API) ([]string, error) {
 		var found bool
 		reg, found, err = api.GetFioNamesForActor(string(p.Owner))
 		if !found || err != nil {
+			excluded[string(p.FioAddress)] = "could not find the fio address for " + string(p.Owner)
 			continue
 		}
-		if !func() bool {
+		if reason := func() string {
 			for _, address := range reg.FioAddresses {
 				if string(p.FioAddress) == (address.FioAddress) {
 					t, e := time.Parse("2006-01-02T15:04:05", address.Expiration)
 					if e != nil {
 						log.Println("error parsing expiration date for", p.FioAddress)
-						return false
+						return "could not parse the fio address expiration " + address.Expiration
 					}
 					if t.After(time.Now()) {
-						return true
+						return ""
 					}
 					log.Println(p.FioAddress, "is expired!")
+					return "fio address expired " + t.Format("2006-01-02")
 				}
 			}
-			return false
-		}() {
+			return "fio address is not owned by " + string(p.Owner)
+		}(); reason != "" {
+			excluded[string(p.FioAddress)] = reason
 			continue
 		}
 
 		registered[string(p.FioAddress)] = true
 	}
+	err = nil
 	if V {
 		log.Println(len(registered), " producers are marked as active")
 	}
 
-	eligible := make([]string, 0)
+	eligible = make([]string, 0)
 	prods := make([]string, 0)
 	if Allowed != "" {
 		f, e := os.Open(Allowed)
@@ -299,7 +352,7 @@ func getEligible(api *fio.API) ([]string, error) {
 			if V {
 				log.Println(e)
 			}
-			return nil, e
+			return nil, nil, e
 		}
 		defer f.Close()
 		fb, e := ioutil.ReadAll(f)
@@ -307,10 +360,19 @@ func getEligible(api *fio.API) ([]string, error) {
 			if V {
 				log.Println(e)
 			}
-			return nil, e
+			return nil, nil, e
 		}
 		prods = strings.Split(string(fb), "\n")
 		rand.Seed(time.Now().UnixNano())
+		listed := make(map[string]bool)
+		for _, prospect := range prods {
+			listed[strings.TrimSpace(prospect)] = true
+		}
+		for p := range registered {
+			if !listed[p] {
+				excluded[p] = "not on the allowed list"
+			}
+		}
 	} else {
 		for p := range registered {
 			prods = append(prods, p)
@@ -327,7 +389,10 @@ func getEligible(api *fio.API) ([]string, error) {
 		case !fio.Address(prospect).Valid() || !strings.HasPrefix(prospect, "#"):
 			log.Println(prospect + " is not a valid fio address")
 		case registered[prospect]:
-			// nop, inactive in producers table
+			// inactive in producers table, the reason was recorded above unless it isn't a producer at all
+			if _, ok := excluded[prospect]; !ok && fio.Address(prospect).Valid() {
+				excluded[prospect] = "not a registered producer"
+			}
 		default:
 			func() {
 				if time.Now().Before(Missed[prospect]) {
@@ -342,9 +407,9 @@ func getEligible(api *fio.API) ([]string, error) {
 
 	}
 	if len(eligible) == 0 {
-		return nil, errors.New("no eligible producers")
+		return nil, nil, errors.New("no eligible producers")
 	}
-	return eligible, nil
+	return eligible, excluded, nil
 }
 
 // ProducerCompact trims the response to only what we need.
@@ -9,7 +9,6 @@ require (
 	github.com/ethereum/go-ethereum v1.9.25
 	github.com/fioprotocol/fio-go v1.0.6-0.20211019173957-98cef1daa416
 	github.com/gizak/termui/v3 v3.1.0
-	github.com/hpcloud/tail v1.0.0
 	github.com/mr-tron/base58 v1.2.0
 	golang.org/x/crypto v0.0.0-20201117144127-c1f2f97bffc9
 	golang.org/x/text v0.3.4